@@ -0,0 +1,808 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ArchiveConfig has the syncer keep every snapshot it receives, for restoring
+// a replica as of any point in time, and the watcher every version of the DBs
+// it serves, for syncers to bootstrap from while it's down. Snapshots are
+// split into chunks stored by their hash, so a chunk is only stored once
+// however many snapshots it's in, and a snapshot that changed a few pages
+// only adds those.
+type ArchiveConfig struct {
+	Enabled bool `yaml:"enabled,omitempty"`
+
+	// where the archive is kept (a directory, or a bucket as
+	// s3://bucket/prefix) instead of <db>.archive beside the DB. It can be
+	// shared between DBs.
+	Dir string `yaml:"dir,omitempty"`
+
+	// snapshots older than this, or past the newest Keep, are dropped (the
+	// newest is always kept)
+	KeepDays int `yaml:"keep_days,omitempty"`
+	Keep     int `yaml:"keep,omitempty"`
+}
+
+const archiveChunkSize = 64 * 1024
+
+// held while archiving and pruning, so chunks a snapshot of another DB is
+// about to refer to aren't collected from under it
+var archive_lock sync.Mutex
+
+// chunks no snapshot refers to are only collected once they're this old, so
+// ones that another watcher or syncer sharing the archive has just stored,
+// for a snapshot it hasn't written the manifest of yet, are left alone
+const chunkGracePeriod = 24 * time.Hour
+
+// snapshot manifests are named <time>.v<version>.json
+var manifestName = regexp.MustCompile(`^(\d{8}T\d{6}\.\d{3}Z)\.v(\d+)\.json$`)
+
+// archiveObject is a chunk or manifest in an archive
+type archiveObject struct {
+	key      string
+	modified time.Time
+}
+
+// archiveStore is where archived chunks and snapshot manifests are kept
+type archiveStore interface {
+	put(key string, data []byte) error
+	get(key string) ([]byte, error)
+	list(prefix string) ([]archiveObject, error)
+	remove(key string) error
+
+	// when the object at key was last stored, or os.ErrNotExist
+	modified(key string) (time.Time, error)
+
+	// how large the chunks snapshots are split into should be
+	chunkSize() int
+}
+
+// dirStore keeps an archive in a local directory
+type dirStore struct {
+	dir string
+}
+
+func (s dirStore) chunkSize() int {
+	return archiveChunkSize
+}
+
+func (s dirStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+func (s dirStore) put(key string, data []byte) error {
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	tmp_path := path + ".tmp"
+	if err := ioutil.WriteFile(tmp_path, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp_path, path)
+}
+
+func (s dirStore) get(key string) ([]byte, error) {
+	return ioutil.ReadFile(s.path(key))
+}
+
+func (s dirStore) modified(key string) (time.Time, error) {
+	info, err := os.Stat(s.path(key))
+	if os.IsNotExist(err) {
+		return time.Time{}, os.ErrNotExist
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return info.ModTime(), nil
+}
+
+func (s dirStore) list(prefix string) ([]archiveObject, error) {
+	var objects []archiveObject
+
+	root := s.path(prefix)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if !info.IsDir() && !strings.HasSuffix(path, ".tmp") {
+			rel, _ := filepath.Rel(s.dir, path)
+			objects = append(objects, archiveObject{key: filepath.ToSlash(rel), modified: info.ModTime()})
+		}
+
+		return nil
+	})
+
+	return objects, err
+}
+
+func (s dirStore) remove(key string) error {
+	return os.Remove(s.path(key))
+}
+
+// archivedSnapshot records which chunks a snapshot is made of. Snapshots are
+// listed by the names of their manifests, which have their time and version,
+// and only the chunks of those that are needed are loaded.
+type archivedSnapshot struct {
+	Time      time.Time `json:"time"`
+	Version   uint64    `json:"version"`
+	Hash      string    `json:"hash"`
+	Redaction string    `json:"redaction,omitempty"`
+	Size      int64     `json:"size"`
+	ChunkSize int64     `json:"chunk_size"`
+	Chunks    []string  `json:"chunks"`
+
+	archiveAccess
+
+	key string
+}
+
+// archiveAccess says which identities the watcher doesn't serve an archived
+// snapshot to as is: those with a filter or redaction profile of their own, a
+// recipient key, or no access to the DB at all. Syncers with one of those
+// identities can't bootstrap from it.
+type archiveAccess struct {
+	// archiveIdentityKey of each of their secrets
+	Restricted []string `json:"restricted,omitempty"`
+
+	// whether any of them only logs in with a certificate, which syncers
+	// can't tell apart from each other by their auth key
+	RestrictedCertificates bool `json:"restricted_certificates,omitempty"`
+}
+
+// archiveIdentityKey stands in for an identity's secret hash in the archive,
+// without giving away the hash it could log in with elsewhere
+func archiveIdentityKey(secret_sha256 string) string {
+	return hashSecret("watchdb-archive\n" + secret_sha256)
+}
+
+// restricts reports whether a syncer with auth_key is one of the identities
+// access leaves out
+func (access archiveAccess) restricts(auth_key string) bool {
+	if auth_key == "" {
+		return access.RestrictedCertificates
+	}
+
+	key := archiveIdentityKey(hashSecret(auth_key))
+	for _, restricted := range access.Restricted {
+		if restricted == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// archiveAccess lists the identities that see db differently from the view
+// that's archived
+func (db *watchedDB) archiveAccess(options WatchConfig) archiveAccess {
+	var access archiveAccess
+	archived := db.viewFor(nil, options).id()
+
+	for _, id := range replicaKeyring.list() {
+		if id.allowed(db.name) && id.Recipient == "" && db.viewFor(id, options).id() == archived {
+			continue
+		}
+
+		if id.SecretSHA256 == "" {
+			access.RestrictedCertificates = true
+		} else {
+			access.Restricted = append(access.Restricted, archiveIdentityKey(id.SecretSHA256))
+		}
+	}
+
+	sort.Strings(access.Restricted)
+
+	return access
+}
+
+func archiveDir(path string, archive ArchiveConfig) string {
+	if archive.Dir != "" {
+		return archive.Dir
+	}
+
+	return path + ".archive"
+}
+
+// openArchiveAt opens the archive at location, a directory or an
+// s3://bucket/prefix URL
+func openArchiveAt(location string, options WatchConfig) (archiveStore, error) {
+	if isS3Location(location) {
+		return newS3Store(location, options.S3)
+	}
+
+	return dirStore{dir: location}, nil
+}
+
+func openArchive(path string, options WatchConfig) (archiveStore, error) {
+	return openArchiveAt(archiveDir(path, options.Archive), options)
+}
+
+func chunkKey(hash string) string {
+	return fmt.Sprintf("chunks/%s/%s", hash[:2], hash)
+}
+
+// snapshots of a DB are kept apart from other DBs' by name: the name it's
+// served under for a watcher, and the replica's file name for a syncer
+func snapshotPrefix(name string) string {
+	return "snapshots/" + name + "/"
+}
+
+// archiveReplica adds the replica at path, just synced to version, to its
+// archive, and drops snapshots that are past keeping
+func archiveReplica(path string, version uint64, hash string, redaction string, options WatchConfig) {
+	if !options.Archive.Enabled {
+		return
+	}
+
+	store, err := openArchive(path, options)
+	if err != nil {
+		log.Warning("unable to open archive of %s: %s", path, err)
+		return
+	}
+
+	archive_lock.Lock()
+	defer archive_lock.Unlock()
+
+	archiveFile(store, filepath.Base(path), path, version, hash, redaction, archiveAccess{}, options)
+}
+
+// archive adds the current snapshot of a watched DB, as replicas see it
+// unless their identity says otherwise, to the archive. Versions that are
+// already archived are skipped, so it can be called as often as needed.
+func (db *watchedDB) archive(options WatchConfig) {
+	if !options.Archive.Enabled {
+		return
+	}
+
+	archive_lock.Lock()
+	defer archive_lock.Unlock()
+
+	current, err := db.acquireView(db.viewFor(nil, options))
+	if err != nil {
+		log.Warning("unable to build view of %s to archive: %s", db.name, err)
+		return
+	}
+	if current == nil {
+		return
+	}
+	defer current.release()
+
+	if current.version <= db.archived_version {
+		return
+	}
+
+	store, err := openArchive(db.path, options)
+	if err != nil {
+		log.Warning("unable to open archive of %s: %s", db.name, err)
+		return
+	}
+
+	// a watcher that's restarted picks up where it left off
+	if db.archived_version == 0 {
+		if snapshots, err := listSnapshots(store, db.name); err == nil && len(snapshots) > 0 {
+			db.archived_version = snapshots[len(snapshots)-1].Version
+			if current.version <= db.archived_version {
+				return
+			}
+		}
+	}
+
+	if archiveFile(store, db.name, current.path, current.version, current.Hash(), current.manifest.Redaction, db.archiveAccess(options), options) {
+		db.archived_version = current.version
+	}
+}
+
+// archiveFile adds the DB at source_path to the snapshots kept under name,
+// and must be called with archive_lock held
+func archiveFile(store archiveStore, name string, source_path string, version uint64, hash string, redaction string, access archiveAccess, options WatchConfig) bool {
+	snapshot, err := archiveSnapshot(store, name, source_path, version, hash, redaction, access)
+	if err != nil {
+		log.Warning("unable to archive %s at version %d: %s", name, version, err)
+		return false
+	}
+
+	log.Debug("archived %s at version %d (%d chunks)", name, version, len(snapshot.Chunks))
+
+	if err := pruneArchive(store, name, options.Archive); err != nil {
+		log.Warning("unable to prune archive of %s: %s", name, err)
+	}
+
+	return true
+}
+
+func archiveSnapshot(store archiveStore, name string, source_path string, version uint64, hash string, redaction string, access archiveAccess) (*archivedSnapshot, error) {
+	file, err := os.Open(source_path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// the newest snapshot's chunks are known to be stored without asking,
+	// which saves a request per chunk against a bucket
+	stored := make(map[string]bool)
+	if snapshots, err := listSnapshots(store, name); err == nil && len(snapshots) > 0 {
+		newest := snapshots[len(snapshots)-1]
+		if err := loadSnapshot(store, newest); err == nil {
+			for _, chunk := range newest.Chunks {
+				stored[chunk] = true
+			}
+		}
+	}
+
+	chunk_size := store.chunkSize()
+
+	snapshot := &archivedSnapshot{
+		Time:          time.Now().UTC(),
+		Version:       version,
+		Hash:          hash,
+		Redaction:     redaction,
+		ChunkSize:     int64(chunk_size),
+		archiveAccess: access,
+	}
+
+	buf := make([]byte, chunk_size)
+	for {
+		n, err := io.ReadFull(file, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+
+		sum := sha256.Sum256(buf[:n])
+		chunk_hash := hex.EncodeToString(sum[:])
+
+		// a chunk that's been stored a while may be one no snapshot refers
+		// to any more, which is stored again so it isn't collected before
+		// this snapshot's manifest is written
+		if !stored[chunk_hash] {
+			modified, err := store.modified(chunkKey(chunk_hash))
+			stored[chunk_hash] = err == nil && time.Since(modified) < chunkGracePeriod/2
+		}
+
+		if !stored[chunk_hash] {
+			var compressed bytes.Buffer
+			gz := gzip.NewWriter(&compressed)
+			gz.Write(buf[:n])
+			gz.Close()
+
+			if err := store.put(chunkKey(chunk_hash), compressed.Bytes()); err != nil {
+				return nil, err
+			}
+			stored[chunk_hash] = true
+		}
+
+		snapshot.Chunks = append(snapshot.Chunks, chunk_hash)
+		snapshot.Size += int64(n)
+
+		if n < chunk_size {
+			break
+		}
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	// chunks go in first, so a snapshot is never recorded without them
+	key := fmt.Sprintf("%s%s.v%d.json", snapshotPrefix(name), snapshot.Time.Format(backupTimeFormat), version)
+	if err := store.put(key, data); err != nil {
+		return nil, err
+	}
+	snapshot.key = key
+
+	return snapshot, nil
+}
+
+// listSnapshots returns the archived snapshots kept under name, oldest
+// first, without loading them
+func listSnapshots(store archiveStore, name string) ([]*archivedSnapshot, error) {
+	prefix := snapshotPrefix(name)
+
+	objects, err := store.list(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []*archivedSnapshot
+	for _, object := range objects {
+		key := object.key
+
+		// snapshots of DBs with names under this one's are further down
+		match := manifestName.FindStringSubmatch(strings.TrimPrefix(key, prefix))
+		if match == nil {
+			continue
+		}
+
+		taken, err := time.Parse(backupTimeFormat, match[1])
+		if err != nil {
+			continue
+		}
+		version, _ := strconv.ParseUint(match[2], 10, 64)
+
+		snapshots = append(snapshots, &archivedSnapshot{Time: taken, Version: version, key: key})
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Time.Before(snapshots[j].Time)
+	})
+
+	return snapshots, nil
+}
+
+// loadSnapshot reads the manifest of a listed snapshot
+func loadSnapshot(store archiveStore, snapshot *archivedSnapshot) error {
+	data, err := store.get(snapshot.key)
+	if err != nil {
+		return err
+	}
+
+	key := snapshot.key
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return fmt.Errorf("unreadable archived snapshot %s: %s", key, err)
+	}
+	snapshot.key = key
+
+	return nil
+}
+
+// archivedNames lists the names snapshots are kept under
+func archivedNames(store archiveStore) ([]string, error) {
+	objects, err := store.list("snapshots/")
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var names []string
+	for _, object := range objects {
+		name, manifest := path.Split(strings.TrimPrefix(object.key, "snapshots/"))
+		name = strings.TrimSuffix(name, "/")
+
+		if name != "" && manifestName.MatchString(manifest) && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// pruneArchive drops the snapshots kept under name that the archive config
+// doesn't keep, and then any chunk no snapshot in the archive (of any DB) is
+// made of, once it's past the grace period
+func pruneArchive(store archiveStore, name string, config ArchiveConfig) error {
+	if config.KeepDays <= 0 && config.Keep <= 0 {
+		return nil
+	}
+
+	snapshots, err := listSnapshots(store, name)
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-time.Duration(config.KeepDays) * 24 * time.Hour)
+	pruned := 0
+	for i, snapshot := range snapshots {
+		newer := len(snapshots) - 1 - i
+		if newer == 0 {
+			break
+		}
+
+		expired := config.KeepDays > 0 && snapshot.Time.Before(cutoff)
+		excess := config.Keep > 0 && newer >= config.Keep
+		if !expired && !excess {
+			continue
+		}
+
+		if err := store.remove(snapshot.key); err != nil {
+			return err
+		}
+		pruned++
+	}
+
+	if pruned == 0 {
+		return nil
+	}
+
+	used := make(map[string]bool)
+
+	names, err := archivedNames(store)
+	if err != nil {
+		return err
+	}
+	for _, archived := range names {
+		kept, err := listSnapshots(store, archived)
+		if err != nil {
+			return err
+		}
+
+		for _, snapshot := range kept {
+			// chunks of a snapshot that can't be read can't be told apart,
+			// so nothing is collected
+			if err := loadSnapshot(store, snapshot); err != nil {
+				return err
+			}
+
+			for _, chunk := range snapshot.Chunks {
+				used[chunkKey(chunk)] = true
+			}
+		}
+	}
+
+	chunks, err := store.list("chunks/")
+	if err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		if !used[chunk.key] && time.Since(chunk.modified) >= chunkGracePeriod {
+			if err := store.remove(chunk.key); err != nil {
+				return err
+			}
+		}
+	}
+
+	log.Debug("pruned %d archived snapshots of %s", pruned, name)
+
+	return nil
+}
+
+// snapshotAt returns the newest of snapshots (oldest first) taken at or
+// before at
+func snapshotAt(snapshots []*archivedSnapshot, at time.Time) *archivedSnapshot {
+	var found *archivedSnapshot
+	for _, snapshot := range snapshots {
+		if snapshot.Time.After(at) {
+			break
+		}
+		found = snapshot
+	}
+
+	return found
+}
+
+// rebuildSnapshot writes an archived snapshot out to out_path, checking every
+// chunk against its hash and then the DB they make up
+func rebuildSnapshot(store archiveStore, snapshot *archivedSnapshot, out_path string) error {
+	out, err := os.OpenFile(out_path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = func() error {
+		for _, chunk_hash := range snapshot.Chunks {
+			data, err := store.get(chunkKey(chunk_hash))
+			if err != nil {
+				return fmt.Errorf("chunk %s is missing from the archive: %s", chunk_hash, err)
+			}
+
+			gz, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return fmt.Errorf("chunk %s is corrupt: %s", chunk_hash, err)
+			}
+
+			chunk, err := ioutil.ReadAll(gz)
+			if err != nil {
+				return fmt.Errorf("chunk %s is corrupt: %s", chunk_hash, err)
+			}
+
+			sum := sha256.Sum256(chunk)
+			if hex.EncodeToString(sum[:]) != chunk_hash {
+				return fmt.Errorf("chunk %s is corrupt", chunk_hash)
+			}
+
+			if _, err := out.Write(chunk); err != nil {
+				return err
+			}
+		}
+
+		return out.Sync()
+	}()
+
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	db, err := openDatabase(out_path)
+	if err == nil {
+		err = db.IntegrityCheck()
+		db.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("rebuilt DB failed verification: %s", err)
+	}
+
+	return nil
+}
+
+// parseRestoreTime reads the time to restore to, in local time unless it
+// says otherwise
+func parseRestoreTime(value string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	return time.Time{}, fmt.Errorf("can't read '%s' as a time, use something like \"2026-10-01 12:00\"", value)
+}
+
+// runRestore rebuilds a replica as of a point in time from its archive,
+// either in place (backing up the current copy first) or to another file
+func runRestore(arguments map[string]interface{}, options WatchConfig) {
+	if len(options.Databases) != 1 {
+		log.Fatal("give the one database to restore")
+	}
+	path := options.Databases[0].Path
+
+	at, err := parseRestoreTime(arguments["--at"].(string))
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	store, err := openArchive(path, options)
+	if err != nil {
+		log.Fatalf("unable to open archive of %s: %s", path, err)
+	}
+
+	snapshots, err := listSnapshots(store, filepath.Base(path))
+	if err != nil {
+		log.Fatalf("unable to read archive of %s: %s", path, err)
+	}
+	if len(snapshots) == 0 {
+		log.Fatalf("there's nothing archived for %s in %s", path, archiveDir(path, options.Archive))
+	}
+
+	snapshot := snapshotAt(snapshots, at)
+	if snapshot == nil {
+		log.Fatalf("the archive of %s only goes back to %s", path, snapshots[0].Time.Local().Format("2006-01-02 15:04:05"))
+	}
+
+	if err := loadSnapshot(store, snapshot); err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	destination, _ := arguments["--out"].(string)
+	if destination != "" {
+		err = rebuildSnapshot(store, snapshot, destination)
+	} else {
+		destination = path
+
+		// the hash is left out, so a syncer brings it up to date rather than
+		// taking it for the current upstream version
+		err = restoreSnapshot(store, snapshot, path, "", options)
+	}
+	if err != nil {
+		log.Fatalf("unable to restore %s: %s", path, err)
+	}
+
+	fmt.Printf("restored %s as of %s (version %d, synced %s) to %s\n", path, at.Format("2006-01-02 15:04:05"), snapshot.Version, snapshot.Time.Local().Format("2006-01-02 15:04:05"), destination)
+}
+
+// restoreSnapshot replaces the replica at path with an archived snapshot,
+// backing up the current copy first, and records hash as its upstream hash
+func restoreSnapshot(store archiveStore, snapshot *archivedSnapshot, path string, hash string, options WatchConfig) error {
+	import_path := importPath(path)
+	_ = os.Remove(import_path)
+	defer os.Remove(import_path)
+
+	if err := rebuildSnapshot(store, snapshot, import_path); err != nil {
+		return err
+	}
+
+	if err := backupReplica(path, options); err != nil {
+		return err
+	}
+
+	if err := replaceReplica(import_path, path); err != nil {
+		return err
+	}
+
+	writeReplicaVersion(path, snapshot.Version, hash, snapshot.Redaction)
+
+	return nil
+}
+
+// bootstrapReplica brings the local copy of database up to the newest
+// snapshot a watcher archived at options.BootstrapFrom, for when the watcher
+// can't be reached. A copy that's at least as new is left alone.
+func bootstrapReplica(database DatabaseConfig, options WatchConfig) error {
+	path := database.Path
+
+	// archived snapshots aren't signed, so there'd be nothing to verify
+	if options.RequireSignature || verify_key != nil {
+		return fmt.Errorf("archived snapshots aren't signed, so they can't be used along with --require-signature or --verify-key")
+	}
+
+	// or encrypted, and a syncer with a decrypt key is only sent encrypted ones
+	if decrypt_key != nil {
+		return fmt.Errorf("archived snapshots aren't encrypted, so they can't be used along with --decrypt-key")
+	}
+
+	store, err := openArchiveAt(options.BootstrapFrom, options)
+	if err != nil {
+		return err
+	}
+
+	// the watcher's only DB is the only one in the archive
+	name := database.Name
+	if name == "" {
+		names, err := archivedNames(store)
+		if err != nil {
+			return err
+		}
+		if len(names) != 1 {
+			return fmt.Errorf("%d DBs are archived in %s, sync one by name (name=path) to bootstrap from it", len(names), options.BootstrapFrom)
+		}
+		name = names[0]
+	}
+
+	snapshots, err := listSnapshots(store, name)
+	if err != nil {
+		return err
+	}
+	if len(snapshots) == 0 {
+		return fmt.Errorf("nothing is archived for %s in %s", name, options.BootstrapFrom)
+	}
+
+	newest := snapshots[len(snapshots)-1]
+	if version, _ := readReplicaVersion(path); version >= newest.Version {
+		log.Info("%s is already at version %d, not bootstrapping it from the archive (at version %d)", path, version, newest.Version)
+		return nil
+	}
+
+	if err := loadSnapshot(store, newest); err != nil {
+		return err
+	}
+
+	// what's archived is what replicas get by default, which may have more
+	// in it than this syncer's identity is allowed to see
+	if newest.restricts(options.AuthKey) {
+		return fmt.Errorf("%s is archived as replicas see it by default, but the watcher serves it differently to this syncer's identity", name)
+	}
+
+	if err := restoreSnapshot(store, newest, path, newest.Hash, options); err != nil {
+		return err
+	}
+	archiveReplica(path, newest.Version, newest.Hash, newest.Redaction, options)
+
+	log.Notice("bootstrapped %s from %s at version %d, archived %s", path, options.BootstrapFrom, newest.Version, newest.Time.Local().Format("2006-01-02 15:04:05"))
+
+	return nil
+}
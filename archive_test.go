@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchiveToS3(t *testing.T) {
+	fake, server := newFakeS3(t)
+	path, db := createTestDB(t, "CREATE TABLE t(x);")
+
+	options := WatchConfig{
+		NoBackup: true,
+		S3:       s3TestConfig(server),
+		Archive:  ArchiveConfig{Enabled: true, Dir: "s3://archive/watchdb", Keep: 2},
+	}
+
+	store, err := openArchive(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each version changes the DB's only chunk, so the chunks of versions
+	// that are pruned aren't used by any other
+	archive := func(version uint64) {
+		if err := db.Exec(fmt.Sprintf("INSERT INTO t VALUES(%d);", version)); err != nil {
+			t.Fatal(err)
+		}
+
+		// manifests are named by the millisecond
+		time.Sleep(2 * time.Millisecond)
+
+		archive_lock.Lock()
+		defer archive_lock.Unlock()
+
+		if !archiveFile(store, "app", path, version, fmt.Sprintf("hash%d", version), "", archiveAccess{}, options) {
+			t.Fatalf("unable to archive version %d", version)
+		}
+	}
+
+	for version := uint64(1); version <= 3; version++ {
+		archive(version)
+	}
+
+	snapshots, err := listSnapshots(store, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 || snapshots[0].Version != 2 || snapshots[1].Version != 3 {
+		t.Fatalf("expected versions 2 and 3 to be kept, got %d snapshots", len(snapshots))
+	}
+
+	// the first version's chunk is no longer used, but it's too new to tell
+	// apart from one of a snapshot that's still being archived elsewhere
+	if chunks := fake.keys("watchdb/chunks/"); len(chunks) != 3 {
+		t.Errorf("expected every chunk to be kept during the grace period, got %d", len(chunks))
+	}
+
+	fake.age(2 * chunkGracePeriod)
+	archive(4)
+
+	if chunks := fake.keys("watchdb/chunks/"); len(chunks) != 2 {
+		t.Errorf("expected the chunks of versions 3 and 4 to be left, got %d", len(chunks))
+	}
+
+	// a chunk that's past the grace period but stored again by another
+	// snapshot is refreshed, rather than taken to be there for good
+	fake.age(2 * chunkGracePeriod)
+	snapshots, _ = listSnapshots(store, "app")
+	newest := snapshots[len(snapshots)-1]
+	if err := loadSnapshot(store, newest); err != nil {
+		t.Fatal(err)
+	}
+
+	archive_lock.Lock()
+	archiveFile(store, "copy", path, 4, "hash4", "", archiveAccess{}, options)
+	archive_lock.Unlock()
+
+	if modified, err := store.modified(chunkKey(newest.Chunks[0])); err != nil || time.Since(modified) > time.Minute {
+		t.Errorf("reused chunk wasn't stored again, last modified %s (%v)", modified, err)
+	}
+
+	for _, method := range []string{"PUT", "LIST", "DELETE"} {
+		if fake.signedCount(method) == 0 {
+			t.Errorf("no signed %s requests were made", method)
+		}
+	}
+
+	// a new replica bootstraps from the newest version
+	replica := filepath.Join(t.TempDir(), "replica.db")
+	bootstrap := options
+	bootstrap.Archive = ArchiveConfig{}
+	bootstrap.BootstrapFrom = "s3://archive/watchdb"
+
+	if err := bootstrapReplica(DatabaseConfig{Name: "app", Path: replica}, bootstrap); err != nil {
+		t.Fatal(err)
+	}
+
+	if version, hash := readReplicaVersion(replica); version != 4 || hash != "hash4" {
+		t.Errorf("bootstrapped replica is at version %d (%s)", version, hash)
+	}
+
+	restored, err := openDatabase(replica)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+
+	if rows := queryValues(t, restored, "SELECT x FROM t ORDER BY x"); strings.Join(rows, ",") != "1,2,3,4" {
+		t.Errorf("bootstrapped replica has rows %v", rows)
+	}
+
+	// there's more than one DB in the archive now, so it has to be named
+	if err := bootstrapReplica(DatabaseConfig{Path: filepath.Join(t.TempDir(), "other.db")}, bootstrap); err == nil {
+		t.Error("bootstrapped without a name from an archive of several DBs")
+	}
+}
+
+func TestBootstrapLeavesOutRestrictedIdentities(t *testing.T) {
+	path, _ := createTestDB(t, "CREATE TABLE users(id, email); INSERT INTO users VALUES(1, 'alice@example.com');")
+	dir := t.TempDir()
+
+	recipient_key := generateTestDecryptKey(t)
+	recipient := base64.StdEncoding.EncodeToString(recipient_key.PublicKey().Bytes())
+
+	options := WatchConfig{
+		AuthKey: "plain-secret",
+		Keyring: []Identity{
+			{Name: "reporting", SecretSHA256: hashSecret("reporting-secret")},
+			{Name: "eu", SecretSHA256: hashSecret("eu-secret"), Filter: "eu"},
+			{Name: "encrypted", SecretSHA256: hashSecret("encrypted-secret"), Recipient: recipient},
+			{Name: "other", SecretSHA256: hashSecret("other-secret"), Databases: []string{"other"}},
+		},
+		Filters: map[string]ReplicationFilter{"eu": {Where: map[string]string{"users": "id > 1"}}},
+		Archive: ArchiveConfig{Enabled: true, Dir: dir},
+	}
+
+	replicaKeyring.load(options)
+	defer replicaKeyring.load(WatchConfig{})
+
+	db := newWatchedDB("app", path)
+	access := db.archiveAccess(options)
+
+	if len(access.Restricted) != 3 || access.RestrictedCertificates {
+		t.Fatalf("expected 3 identities with a secret to be restricted, got %d (certificates: %t)", len(access.Restricted), access.RestrictedCertificates)
+	}
+
+	store, err := openArchive(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive_lock.Lock()
+	archived := archiveFile(store, "app", path, 1, "hash1", "", access, options)
+	archive_lock.Unlock()
+	if !archived {
+		t.Fatal("unable to archive")
+	}
+
+	bootstrap := func(auth_key string) error {
+		return bootstrapReplica(DatabaseConfig{Name: "app", Path: filepath.Join(t.TempDir(), "replica.db")}, WatchConfig{AuthKey: auth_key, BootstrapFrom: dir})
+	}
+
+	for _, auth_key := range []string{"plain-secret", "reporting-secret"} {
+		if err := bootstrap(auth_key); err != nil {
+			t.Errorf("syncer with %s couldn't bootstrap: %s", auth_key, err)
+		}
+	}
+
+	for _, auth_key := range []string{"eu-secret", "encrypted-secret", "other-secret"} {
+		if err := bootstrap(auth_key); err == nil {
+			t.Errorf("syncer with %s bootstrapped from a view it isn't served", auth_key)
+		}
+	}
+
+	// a syncer with a decrypt key is only ever sent encrypted snapshots
+	decrypt_key = recipient_key
+	defer func() {
+		decrypt_key = nil
+	}()
+
+	if err := bootstrap("plain-secret"); err == nil {
+		t.Error("syncer with a decrypt key bootstrapped from an unencrypted archive")
+	}
+	decrypt_key = nil
+
+	// syncers that only have a certificate can't be told apart
+	options.Keyring = append(options.Keyring, Identity{Name: "auditor", Redaction: "pii"})
+	options.Redactions = map[string]RedactionProfile{"pii": {Columns: []RedactionRule{{Table: "users", Column: "email", Action: "fixed", Value: "redacted"}}}}
+	replicaKeyring.load(options)
+
+	if access := db.archiveAccess(options); !access.RestrictedCertificates || !access.restricts("") || access.restricts("plain-secret") {
+		t.Errorf("identity with only a certificate wasn't restricted: %+v", access)
+	}
+}
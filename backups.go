@@ -0,0 +1,362 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BackupPolicy is how many previous copies of a replica are kept, each taken
+// just before an update replaces it. The newest Keep are kept, along with the
+// newest of each of the last Hourly hours and Daily days, as long as they
+// take up no more than MaxSizeMB altogether.
+type BackupPolicy struct {
+	Keep      int   `yaml:"keep,omitempty"`
+	Hourly    int   `yaml:"hourly,omitempty"`
+	Daily     int   `yaml:"daily,omitempty"`
+	MaxSizeMB int64 `yaml:"max_size_mb,omitempty"`
+	Compress  bool  `yaml:"compress,omitempty"`
+
+	// where backups are kept, instead of <db>.backups beside the DB
+	Dir string `yaml:"dir,omitempty"`
+}
+
+const backupTimeFormat = "20060102T150405.000Z"
+
+// backup files are named <db file>.<time>.v<version>.db, with .gz when
+// they're compressed
+var backupName = regexp.MustCompile(`^(.+)\.(\d{8}T\d{6}\.\d{3}Z)\.v(\d+)\.db(\.gz)?$`)
+
+type replicaBackup struct {
+	path       string
+	time       time.Time
+	version    uint64
+	size       int64
+	compressed bool
+}
+
+func backupDir(path string, policy BackupPolicy) string {
+	if policy.Dir != "" {
+		return policy.Dir
+	}
+
+	return path + ".backups"
+}
+
+// listBackups returns the backups of the replica at path, newest first
+func listBackups(path string, policy BackupPolicy) ([]replicaBackup, error) {
+	entries, err := ioutil.ReadDir(backupDir(path, policy))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []replicaBackup
+	for _, entry := range entries {
+		match := backupName.FindStringSubmatch(entry.Name())
+		if match == nil || match[1] != filepath.Base(path) {
+			continue
+		}
+
+		taken, err := time.Parse(backupTimeFormat, match[2])
+		if err != nil {
+			continue
+		}
+		version, _ := strconv.ParseUint(match[3], 10, 64)
+
+		backups = append(backups, replicaBackup{
+			path:       filepath.Join(backupDir(path, policy), entry.Name()),
+			time:       taken,
+			version:    version,
+			size:       entry.Size(),
+			compressed: match[4] != "",
+		})
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].time.After(backups[j].time)
+	})
+
+	return backups, nil
+}
+
+// backupReplica keeps a copy of the replica at path before it's replaced,
+// and prunes backups the policy doesn't keep
+func backupReplica(path string, options WatchConfig) error {
+	if options.NoBackup {
+		return nil
+	}
+
+	if dbexists, _ := exists(path); !dbexists {
+		return nil
+	}
+
+	policy := options.Backups
+	version, _ := readReplicaVersion(path)
+
+	name := fmt.Sprintf("%s.%s.v%d.db", filepath.Base(path), time.Now().UTC().Format(backupTimeFormat), version)
+	if policy.Compress {
+		name += ".gz"
+	}
+
+	dir := backupDir(path, policy)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return syncFailure("backup", "unable to create backup directory: %s", err)
+	}
+
+	if err := writeBackup(path, filepath.Join(dir, name), policy.Compress); err != nil {
+		err = syncFailure("backup", "unable to back up current sqlite database: %s", err)
+		if status := replicas.get(path); status != nil {
+			status.backupFailed(err)
+		}
+		return err
+	}
+
+	pruneBackups(path, policy)
+
+	return nil
+}
+
+func writeBackup(path string, backup_path string, compress bool) error {
+	if !compress {
+		return copyFileContents(path, backup_path)
+	}
+
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(backup_path)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		_ = os.Remove(backup_path)
+	}
+
+	return err
+}
+
+// keptBackups decides which of backups (newest first) the policy keeps. The
+// newest one is always kept.
+func keptBackups(backups []replicaBackup, policy BackupPolicy) map[string]bool {
+	kept := make(map[string]bool)
+
+	keep := policy.Keep
+	if keep < 1 {
+		keep = 1
+	}
+	for i := 0; i < len(backups) && i < keep; i++ {
+		kept[backups[i].path] = true
+	}
+
+	// the newest backup of each period, for as many periods as are kept
+	periodic := func(count int, period func(t time.Time) string) {
+		seen := make(map[string]bool)
+		for _, backup := range backups {
+			if len(seen) >= count {
+				break
+			}
+
+			key := period(backup.time.Local())
+			if !seen[key] {
+				seen[key] = true
+				kept[backup.path] = true
+			}
+		}
+	}
+	periodic(policy.Hourly, func(t time.Time) string { return t.Format("2006-01-02 15") })
+	periodic(policy.Daily, func(t time.Time) string { return t.Format("2006-01-02") })
+
+	if policy.MaxSizeMB > 0 {
+		var total int64
+		for i, backup := range backups {
+			if !kept[backup.path] {
+				continue
+			}
+
+			total += backup.size
+			if i > 0 && total > policy.MaxSizeMB*1024*1024 {
+				delete(kept, backup.path)
+			}
+		}
+	}
+
+	return kept
+}
+
+func pruneBackups(path string, policy BackupPolicy) {
+	backups, err := listBackups(path, policy)
+	if err != nil {
+		log.Warning("unable to list backups of %s: %s", path, err)
+		return
+	}
+
+	kept := keptBackups(backups, policy)
+
+	for _, backup := range backups {
+		if kept[backup.path] {
+			continue
+		}
+
+		if err := os.Remove(backup.path); err != nil {
+			log.Warning("unable to remove old backup %s: %s", backup.path, err)
+			continue
+		}
+
+		log.Debug("removed old backup %s", backup.path)
+	}
+}
+
+// restoreBackup rolls the replica at path back to backup. The current copy
+// is backed up first, so a restore can itself be undone.
+func restoreBackup(path string, backup replicaBackup, options WatchConfig) error {
+	in, err := os.Open(backup.path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var source io.Reader = in
+	if backup.compressed {
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			return err
+		}
+		source = gz
+	}
+
+	import_path := importPath(path)
+	_ = os.Remove(import_path)
+	defer os.Remove(import_path)
+
+	out, err := os.Create(import_path)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, source)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read backup: %s", err)
+	}
+
+	if err := backupReplica(path, options); err != nil {
+		return err
+	}
+
+	// the hash is of what was restored, so a syncer only takes it for
+	// upstream's version if it's exactly what upstream has
+	page_size, err := readPageSize(import_path)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := buildPageManifest(import_path, page_size)
+	if err != nil {
+		return err
+	}
+
+	if err := replaceReplica(import_path, path); err != nil {
+		return err
+	}
+
+	writeReplicaVersion(path, backup.version, manifest.Id, readReplicaRedaction(path))
+
+	return nil
+}
+
+// runBackups handles the backups subcommands
+func runBackups(arguments map[string]interface{}, options WatchConfig) {
+	switch {
+	case arguments["list"].(bool):
+		for _, database := range options.Databases {
+			backups, err := listBackups(database.Path, options.Backups)
+			if err != nil {
+				log.Fatalf("unable to list backups of %s: %s", database.Path, err)
+			}
+
+			fmt.Printf("%s (%d backups in %s)\n", database.Path, len(backups), backupDir(database.Path, options.Backups))
+			for i, backup := range backups {
+				fmt.Printf("  %3d  %s  version %-8d %10s  %s\n", i+1, backup.time.Local().Format("2006-01-02 15:04:05"), backup.version, formatSize(backup.size), filepath.Base(backup.path))
+			}
+		}
+	case arguments["restore"].(bool):
+		if len(options.Databases) != 1 {
+			log.Fatal("give the one database to restore")
+		}
+		path := options.Databases[0].Path
+
+		backups, err := listBackups(path, options.Backups)
+		if err != nil {
+			log.Fatalf("unable to list backups of %s: %s", path, err)
+		}
+
+		// a generation is a number from backups list, or a backup's file name
+		generation := arguments["<generation>"].(string)
+		var chosen *replicaBackup
+		for i := range backups {
+			if strconv.Itoa(i+1) == generation || filepath.Base(backups[i].path) == generation {
+				chosen = &backups[i]
+				break
+			}
+		}
+		if chosen == nil {
+			log.Fatalf("no backup '%s' of %s, see watchdb backups list", generation, path)
+		}
+
+		if err := restoreBackup(path, *chosen, options); err != nil {
+			log.Fatalf("unable to restore %s: %s", path, err)
+		}
+
+		fmt.Printf("restored %s to version %d from %s\n", path, chosen.version, filepath.Base(chosen.path))
+		fmt.Printf("a syncer that's still running will bring it back up to date with upstream\n")
+	}
+}
+
+func formatSize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB"}
+
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	return strings.TrimSuffix(strings.TrimSuffix(fmt.Sprintf("%.1f", value), "0"), ".") + " " + units[unit]
+}
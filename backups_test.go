@@ -0,0 +1,35 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestReplicaVersionRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "replica.db")
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		hash      string
+		redaction string
+	}{
+		{"abc123", ""},
+		{"abc123", "staging"},
+		{"", "staging"},
+		{"", ""},
+	} {
+		writeReplicaVersion(path, 7, test.hash, test.redaction)
+
+		version, hash := readReplicaVersion(path)
+		if version != 7 || hash != test.hash {
+			t.Errorf("wrote version 7 with hash %q, read back %d with %q", test.hash, version, hash)
+		}
+
+		if redaction := readReplicaRedaction(path); redaction != test.redaction {
+			t.Errorf("wrote redaction %q with hash %q, read back %q", test.redaction, test.hash, redaction)
+		}
+	}
+}
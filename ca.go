@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/dkulchenko/watchdb/ssl"
+)
+
+// the organization certificates watchdb creates are issued to
+const certOrganization = "watchdb"
+
+func caDir(options WatchConfig) string {
+	if options.CADir != "" {
+		return options.CADir
+	}
+
+	return path.Join(createWatchDBDir(), "ca")
+}
+
+func certValidity(options WatchConfig) time.Duration {
+	return time.Duration(options.SSLValidDays) * 24 * time.Hour
+}
+
+// certificateHosts is what a watcher's certificate has to be valid for: the
+// configured hosts, or the address it binds to along with this machine's
+// hostname and localhost
+func certificateHosts(options WatchConfig) []string {
+	if len(options.SSLHosts) > 0 {
+		return options.SSLHosts
+	}
+
+	var hosts []string
+	if ip := net.ParseIP(options.BindAddr); ip == nil || !ip.IsUnspecified() {
+		hosts = append(hosts, options.BindAddr)
+	}
+
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		hosts = append(hosts, hostname)
+	}
+
+	return append(hosts, "localhost", "127.0.0.1", "::1")
+}
+
+// ensureSelfSignedCert returns the paths of the watcher's generated
+// certificate, which is kept as long as it's valid for the configured hosts
+// and isn't about to expire
+func ensureSelfSignedCert(options WatchConfig) (string, string, error) {
+	watchdb_dir := createWatchDBDir()
+	cert_path := path.Join(watchdb_dir, "watchdb-cert.pem")
+	key_path := path.Join(watchdb_dir, "watchdb-key.pem")
+
+	hosts := certificateHosts(options)
+
+	cert, err := ssl.LoadCertificate(cert_path)
+	if err == nil {
+		_, key_err := os.Stat(key_path)
+
+		switch {
+		case key_err != nil:
+			log.Notice("replacing generated certificate %s, its key is missing", cert_path)
+		case ssl.ExpiresSoon(cert):
+			log.Notice("replacing generated certificate %s, it expires %s", cert_path, cert.NotAfter.Format("2006-01-02"))
+		case !ssl.Covers(cert, hosts):
+			log.Notice("replacing generated certificate %s, it isn't valid for %s", cert_path, strings.Join(hosts, ", "))
+		default:
+			log.Info("using generated certificate %s", cert_path)
+			return cert_path, key_path, nil
+		}
+	} else {
+		log.Warning("ssl cert file and key file weren't specified, automatically generating")
+	}
+
+	cert, err = ssl.GenerateSelfSignedCerts(cert_path, key_path, ssl.CertOptions{
+		Name:         hosts[0],
+		Hosts:        hosts,
+		Organization: certOrganization,
+		ValidFor:     certValidity(options),
+	}, true)
+	if err != nil {
+		return "", "", err
+	}
+
+	log.Notice("generated certificate %s for %s, valid until %s", cert_path, strings.Join(hosts, ", "), cert.NotAfter.Format("2006-01-02"))
+
+	return cert_path, key_path, nil
+}
+
+// warnExpiring logs a warning when the certificate at cert_path is about to
+// expire (or has)
+func warnExpiring(cert_path string, what string) {
+	if cert_path == "" {
+		return
+	}
+
+	cert, err := ssl.LoadCertificate(cert_path)
+	if err != nil {
+		return
+	}
+
+	switch {
+	case time.Now().After(cert.NotAfter):
+		log.Error("%s %s expired on %s", what, cert_path, cert.NotAfter.Format("2006-01-02"))
+	case ssl.ExpiresSoon(cert):
+		log.Warning("%s %s expires on %s, renew it soon (watchdb ca renew)", what, cert_path, cert.NotAfter.Format("2006-01-02"))
+	}
+}
+
+// warnExpiringCerts checks every certificate a watcher or syncer uses
+func warnExpiringCerts(options WatchConfig, watch bool) {
+	if watch {
+		warnExpiring(options.SSLCertFile, "certificate")
+		warnExpiring(options.SSLClientCAFile, "client CA")
+	} else {
+		warnExpiring(options.SSLClientCertFile, "client certificate")
+		warnExpiring(options.SSLCAFile, "CA")
+	}
+}
+
+// runCA handles the ca subcommands, which run a small CA for issuing
+// watchers' and syncers' certificates
+func runCA(arguments map[string]interface{}, options WatchConfig) {
+	dir := caDir(options)
+
+	switch {
+	case arguments["init"].(bool):
+		hostname, _ := os.Hostname()
+
+		ca, err := ssl.InitCA(dir, ssl.CertOptions{
+			Name:         strings.TrimSpace("watchdb CA " + hostname),
+			Organization: certOrganization,
+			ValidFor:     10 * certValidity(options),
+		})
+		if err != nil {
+			log.Fatalf("unable to create CA: %s", err)
+		}
+
+		fmt.Printf("created CA in %s, valid until %s\n\n", dir, ca.Cert.NotAfter.Format("2006-01-02"))
+		fmt.Printf("give watchers --ssl-client-ca=%s and syncers --ssl-ca=%s\n", ca.CertPath(), ca.CertPath())
+		fmt.Printf("(the CA's key, ca.key, stays here)\n")
+	case arguments["issue"].(bool):
+		ca, err := ssl.LoadCA(dir)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+
+		name := arguments["<cert-name>"].([]string)[0]
+		role, _ := arguments["--role"].(string)
+
+		cert_options := ssl.CertOptions{
+			Name:         name,
+			Organization: certOrganization,
+			ValidFor:     certValidity(options),
+		}
+		if role == ssl.RoleServer {
+			cert_options.Hosts = certificateHosts(options)
+		}
+
+		cert, err := ca.Issue(role, cert_options)
+		if err != nil {
+			log.Fatalf("unable to issue certificate: %s", err)
+		}
+
+		cert_path, key_path := ca.IssuedPaths(name)
+		fmt.Printf("issued %s certificate %s (key %s), valid until %s\n", role, cert_path, key_path, cert.NotAfter.Format("2006-01-02"))
+
+		if role == ssl.RoleServer {
+			fmt.Printf("valid for %s\n\n", strings.Join(cert_options.Hosts, ", "))
+			fmt.Printf("give the watcher --ssl-cert-file=%s --ssl-key-file=%s\n", cert_path, key_path)
+		} else {
+			fmt.Printf("\ngive the syncer --ssl-client-cert=%s --ssl-client-key=%s\n", cert_path, key_path)
+			fmt.Printf("it's known as %s, which can be given an entry in the watcher's keyring\n", name)
+		}
+	case arguments["renew"].(bool):
+		ca, err := ssl.LoadCA(dir)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+
+		if ssl.ExpiresSoon(ca.Cert) {
+			log.Warning("the CA itself expires on %s, certificates it issues can't outlive it", ca.Cert.NotAfter.Format("2006-01-02"))
+		}
+
+		// with no names, everything that's due for renewal is renewed
+		names, _ := arguments["<cert-name>"].([]string)
+		forced := len(names) > 0
+		if !forced {
+			if names, err = ca.Issued(); err != nil {
+				log.Fatalf("unable to list certificates: %s", err)
+			}
+		}
+
+		renewed := 0
+		for _, name := range names {
+			cert_path, _ := ca.IssuedPaths(name)
+
+			current, err := ssl.LoadCertificate(cert_path)
+			if err != nil {
+				log.Error("unable to read %s: %s", cert_path, err)
+				continue
+			}
+
+			if !forced && !ssl.ExpiresSoon(current) {
+				continue
+			}
+
+			cert, err := ca.Renew(cert_path, ssl.CertOptions{ValidFor: certValidity(options)})
+			if err != nil {
+				log.Error("unable to renew %s: %s", name, err)
+				continue
+			}
+
+			fmt.Printf("renewed %s certificate %s, valid until %s\n", ssl.Role(cert), cert_path, cert.NotAfter.Format("2006-01-02"))
+			renewed++
+		}
+
+		if renewed == 0 && !forced {
+			fmt.Printf("nothing expires in the next %d days\n", int(ssl.RenewBefore.Hours()/24))
+		}
+	}
+}
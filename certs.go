@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"sync"
+	"time"
+
+	"github.com/dkulchenko/watchdb/ssl"
+	"github.com/howeyc/fsnotify"
+)
+
+// how long to wait after the certificate or key changes before reloading
+// them, since they're usually written one after the other
+const certReloadDelay = 500 * time.Millisecond
+
+// how often a generated certificate is checked for renewal
+const certRenewInterval = 12 * time.Hour
+
+// certReloader hands the watcher's certificate to TLS handshakes, and swaps
+// it for a new one whenever its files change, so certificates can be rotated
+// without dropping syncers
+type certReloader struct {
+	cert_path string
+	key_path  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	pin  string
+
+	timer_lock sync.Mutex
+	timer      *time.Timer
+}
+
+func newCertReloader(cert_path string, key_path string) (*certReloader, error) {
+	c := &certReloader{cert_path: cert_path, key_path: key_path}
+
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// load reads the certificate and key, keeping the current ones if they can't
+// be loaded (say, because only one of them has been replaced so far)
+func (c *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(c.cert_path, c.key_path)
+	if err != nil {
+		return err
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	cert.Leaf = leaf
+
+	pin := ssl.Pin(leaf)
+
+	c.mu.Lock()
+	previous := c.pin
+	c.cert = &cert
+	c.pin = pin
+	c.mu.Unlock()
+
+	switch {
+	case previous == "":
+		log.Info("syncers can pin this watcher's certificate with --ssl-pin=%s", pin)
+	case previous != pin:
+		log.Warning("certificate's key changed, syncers pinning the old one need --ssl-pin=%s", pin)
+	}
+
+	if ssl.ExpiresSoon(leaf) {
+		log.Warning("certificate %s expires on %s, renew it soon (watchdb ca renew)", c.cert_path, leaf.NotAfter.Format("2006-01-02"))
+	}
+
+	return nil
+}
+
+func (c *certReloader) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.cert, nil
+}
+
+// handleEvent reloads the certificate once its files have settled
+func (c *certReloader) handleEvent(ev *fsnotify.FileEvent) {
+	c.timer_lock.Lock()
+	defer c.timer_lock.Unlock()
+
+	if c.timer != nil {
+		c.timer.Reset(certReloadDelay)
+		return
+	}
+
+	c.timer = time.AfterFunc(certReloadDelay, func() {
+		c.timer_lock.Lock()
+		c.timer = nil
+		c.timer_lock.Unlock()
+
+		if err := c.load(); err != nil {
+			log.Error("unable to reload certificate %s, still using the previous one: %s", c.cert_path, err)
+			return
+		}
+
+		c.mu.RLock()
+		not_after := c.cert.Leaf.NotAfter
+		c.mu.RUnlock()
+
+		log.Notice("reloaded certificate %s, valid until %s", c.cert_path, not_after.Format("2006-01-02"))
+	})
+}
+
+// watch reloads the certificate whenever its files change
+func (c *certReloader) watch(fw *fileWatcher) error {
+	if err := fw.addFile(c.cert_path, c.handleEvent); err != nil {
+		return err
+	}
+
+	return fw.addFile(c.key_path, c.handleEvent)
+}
+
+// renewGenerated replaces a generated certificate before it expires. The new
+// one is picked up like any other change to its files.
+func (c *certReloader) renewGenerated(options WatchConfig) {
+	for range time.Tick(certRenewInterval) {
+		c.mu.RLock()
+		leaf := c.cert.Leaf
+		c.mu.RUnlock()
+
+		if !ssl.ExpiresSoon(leaf) {
+			continue
+		}
+
+		if _, _, err := ensureSelfSignedCert(options); err != nil {
+			log.Error("unable to renew generated certificate: %s", err)
+		}
+	}
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The change feed records every row-level change to a watched DB in a side
+// table, through triggers the watcher installs on each table. Rows are kept
+// as lists of column names and values rendered by quote(), which the triggers
+// can produce without any extensions and which keep values exact.
+
+const changesTable = "_watchdb_changes"
+
+// how many changes /changes returns at most per request
+const maxChangesPerRequest = 10000
+
+type feedTable struct {
+	name    string
+	columns []string
+	key     []string
+}
+
+// changeFeedSchema fingerprints the schema, so triggers are only reinstalled
+// once it changes
+func changeFeedSchema(source Database) (string, error) {
+	rows, err := source.Query("SELECT type, name, sql FROM sqlite_master ORDER BY type, name")
+	if err != nil {
+		return "", err
+	}
+
+	h := md5.New()
+	for _, row := range rows {
+		fmt.Fprintf(h, "%v\x00%v\x00%v\n", row...)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func feedTables(source Database) ([]feedTable, error) {
+	rows, err := source.Query(`SELECT m.name, p.name, p.pk FROM sqlite_master m, pragma_table_info(m.name) p
+		WHERE m.type = 'table' AND m.name NOT LIKE 'sqlite\_%' ESCAPE '\' AND m.name NOT LIKE '\_watchdb\_%' ESCAPE '\'
+		AND m.sql NOT LIKE 'CREATE VIRTUAL%' ORDER BY m.name, p.cid`)
+	if err != nil {
+		return nil, err
+	}
+
+	type keyColumn struct {
+		pk   int64
+		name string
+	}
+
+	var tables []feedTable
+	keys := make(map[string][]keyColumn)
+
+	for _, row := range rows {
+		name, column, pk := asString(row[0]), asString(row[1]), asInt64(row[2])
+
+		if len(tables) == 0 || tables[len(tables)-1].name != name {
+			tables = append(tables, feedTable{name: name})
+		}
+
+		table := &tables[len(tables)-1]
+		table.columns = append(table.columns, column)
+
+		if pk > 0 {
+			keys[name] = append(keys[name], keyColumn{pk: pk, name: column})
+		}
+	}
+
+	for i := range tables {
+		// primary key columns are numbered in key order, not table order
+		key := keys[tables[i].name]
+		sort.Slice(key, func(a, b int) bool { return key[a].pk < key[b].pk })
+
+		for _, column := range key {
+			tables[i].key = append(tables[i].key, column.name)
+		}
+
+		if len(tables[i].key) == 0 {
+			tables[i].key = []string{"rowid"}
+		}
+	}
+
+	return tables, nil
+}
+
+type feedTrigger struct {
+	name string
+	sql  string
+}
+
+// installedTriggers returns the change feed triggers in a DB, by name
+func installedTriggers(source Database) (map[string]string, error) {
+	rows, err := source.Query(`SELECT name, sql FROM sqlite_master WHERE type = 'trigger' AND name LIKE '\_watchdb\_%' ESCAPE '\'`)
+	if err != nil {
+		return nil, err
+	}
+
+	triggers := make(map[string]string)
+	for _, row := range rows {
+		triggers[asString(row[0])] = asString(row[1])
+	}
+
+	return triggers, nil
+}
+
+// hasChangeFeed reports whether the DB at path has the change feed's table or
+// any of its triggers in it
+func hasChangeFeed(path string) (bool, error) {
+	source, err := openDatabase(path)
+	if err != nil {
+		return false, err
+	}
+	defer source.Close()
+
+	rows, err := source.Query(fmt.Sprintf(`SELECT 1 FROM sqlite_master WHERE (type = 'table' AND name = %s) OR (type = 'trigger' AND name LIKE '\_watchdb\_%%' ESCAPE '\') LIMIT 1`, quoteLiteral(changesTable)))
+	if err != nil {
+		return false, err
+	}
+
+	return len(rows) > 0, nil
+}
+
+// valuesExpr renders columns of a row (NEW or OLD) as a list of name,value
+// literals, e.g. 'id',1,'name','bob'
+func valuesExpr(row string, columns []string) string {
+	parts := make([]string, len(columns))
+	for i, column := range columns {
+		parts[i] = fmt.Sprintf("%s || quote(%s.%s)", quoteLiteral(quoteLiteral(column)+","), row, quoteIdentifier(column))
+	}
+
+	return strings.Join(parts, " || ',' || ")
+}
+
+func feedTriggers(tables []feedTable) []feedTrigger {
+	var triggers []feedTrigger
+
+	insert := fmt.Sprintf("INSERT INTO %s(tbl, op, row_key, old_values, new_values)", quoteIdentifier(changesTable))
+
+	for _, table := range tables {
+		triggers = append(triggers,
+			feedTrigger{
+				name: "_watchdb_" + table.name + "_insert",
+				sql: fmt.Sprintf("CREATE TRIGGER %s AFTER INSERT ON %s BEGIN %s VALUES(%s, 'insert', %s, NULL, %s); END",
+					quoteIdentifier("_watchdb_"+table.name+"_insert"), quoteIdentifier(table.name), insert,
+					quoteLiteral(table.name), valuesExpr("NEW", table.key), valuesExpr("NEW", table.columns)),
+			},
+			feedTrigger{
+				name: "_watchdb_" + table.name + "_update",
+				sql: fmt.Sprintf("CREATE TRIGGER %s AFTER UPDATE ON %s BEGIN %s VALUES(%s, 'update', %s, %s, %s); END",
+					quoteIdentifier("_watchdb_"+table.name+"_update"), quoteIdentifier(table.name), insert,
+					quoteLiteral(table.name), valuesExpr("OLD", table.key), valuesExpr("OLD", table.columns), valuesExpr("NEW", table.columns)),
+			},
+			feedTrigger{
+				name: "_watchdb_" + table.name + "_delete",
+				sql: fmt.Sprintf("CREATE TRIGGER %s AFTER DELETE ON %s BEGIN %s VALUES(%s, 'delete', %s, %s, NULL); END",
+					quoteIdentifier("_watchdb_"+table.name+"_delete"), quoteIdentifier(table.name), insert,
+					quoteLiteral(table.name), valuesExpr("OLD", table.key), valuesExpr("OLD", table.columns)),
+			},
+		)
+	}
+
+	return triggers
+}
+
+// changeFeedScript replaces whatever change feed triggers are installed with
+// the given ones
+func changeFeedScript(triggers []feedTrigger, installed map[string]string) string {
+	var script bytes.Buffer
+
+	script.WriteString("BEGIN;\n")
+	fmt.Fprintf(&script, "CREATE TABLE IF NOT EXISTS %s (seq INTEGER PRIMARY KEY AUTOINCREMENT, tbl TEXT NOT NULL, op TEXT NOT NULL, row_key TEXT, old_values TEXT, new_values TEXT, at INTEGER NOT NULL DEFAULT (CAST(strftime('%%s', 'now') AS INTEGER)));\n", quoteIdentifier(changesTable))
+
+	for name := range installed {
+		fmt.Fprintf(&script, "DROP TRIGGER IF EXISTS %s;\n", quoteIdentifier(name))
+	}
+
+	for _, trigger := range triggers {
+		fmt.Fprintf(&script, "%s;\n", trigger.sql)
+	}
+
+	script.WriteString("COMMIT;\n")
+
+	return script.String()
+}
+
+// maintainChangeFeed installs the change feed triggers on a DB (again, if its
+// schema changed since) and trims old changes
+func (db *watchedDB) maintainChangeFeed(options WatchConfig) error {
+	source, err := openDatabase(db.path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	schema, err := changeFeedSchema(source)
+	if err != nil {
+		return err
+	}
+
+	if schema != db.feed_schema {
+		tables, err := feedTables(source)
+		if err != nil {
+			return err
+		}
+
+		installed, err := installedTriggers(source)
+		if err != nil {
+			return err
+		}
+
+		has_table, err := source.Query(fmt.Sprintf("SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = %s", quoteLiteral(changesTable)))
+		if err != nil {
+			return err
+		}
+
+		// rewriting identical triggers would still change the DB, and with
+		// it the version
+		triggers := feedTriggers(tables)
+		current := len(has_table) > 0 && len(installed) == len(triggers)
+		for _, trigger := range triggers {
+			if installed[trigger.name] != trigger.sql {
+				current = false
+			}
+		}
+
+		if !current {
+			if err := source.Exec(changeFeedScript(triggers, installed)); err != nil {
+				return fmt.Errorf("unable to install change feed triggers: %s", err)
+			}
+
+			log.Info("change feed installed on %d tables of %s", len(tables), db.name)
+
+			if schema, err = changeFeedSchema(source); err != nil {
+				return err
+			}
+		}
+
+		db.feed_schema = schema
+	}
+
+	rows, err := source.Query(fmt.Sprintf("SELECT MIN(seq), MAX(seq) FROM %s", quoteIdentifier(changesTable)))
+	if err != nil || len(rows) == 0 || rows[0][0] == nil {
+		return err
+	}
+
+	// trimming is a write too, so it's left until there's a bit to trim
+	oldest, newest := asInt64(rows[0][0]), asInt64(rows[0][1])
+	if newest-oldest+1 > options.ChangeRetention+options.ChangeRetention/10 {
+		err := source.Exec(fmt.Sprintf("DELETE FROM %s WHERE seq <= %d;", quoteIdentifier(changesTable), newest-options.ChangeRetention))
+		if err != nil {
+			return fmt.Errorf("unable to trim change feed: %s", err)
+		}
+
+		log.Debug("trimmed change feed of %s to the last %d changes", db.name, options.ChangeRetention)
+	}
+
+	return nil
+}
+
+// parseLiterals reads a comma separated list of SQL literals as written by
+// quote(): NULL, numbers, 'text' and X'blobs'
+func parseLiterals(s string) ([]interface{}, error) {
+	var values []interface{}
+
+	for i := 0; i < len(s); {
+		switch {
+		case s[i] == '\'':
+			var text strings.Builder
+			i++
+			for {
+				if i >= len(s) {
+					return nil, fmt.Errorf("unterminated string in %.100s", s)
+				}
+				if s[i] == '\'' {
+					if i+1 < len(s) && s[i+1] == '\'' {
+						text.WriteByte('\'')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				text.WriteByte(s[i])
+				i++
+			}
+			values = append(values, text.String())
+		case (s[i] == 'X' || s[i] == 'x') && i+1 < len(s) && s[i+1] == '\'':
+			end := strings.IndexByte(s[i+2:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated blob in %.100s", s)
+			}
+			data, err := hex.DecodeString(s[i+2 : i+2+end])
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, data)
+			i += end + 3
+		default:
+			end := strings.IndexByte(s[i:], ',')
+			if end < 0 {
+				end = len(s) - i
+			}
+			token := s[i : i+end]
+			i += end
+
+			if token == "NULL" {
+				values = append(values, nil)
+			} else if n, err := strconv.ParseInt(token, 10, 64); err == nil {
+				values = append(values, n)
+			} else if f, err := strconv.ParseFloat(token, 64); err == nil || math.IsInf(f, 0) {
+				values = append(values, f)
+			} else {
+				return nil, fmt.Errorf("unknown value %.100s", token)
+			}
+		}
+
+		if i < len(s) {
+			if s[i] != ',' {
+				return nil, fmt.Errorf("unexpected %q in %.100s", s[i], s)
+			}
+			i++
+		}
+	}
+
+	return values, nil
+}
+
+type columnValue struct {
+	Name  string
+	Value interface{}
+}
+
+// rowValues are the columns of a row, which stay in table order when encoded
+// as a JSON object. Blobs are encoded as {"blob": "<hex>"}.
+type rowValues []columnValue
+
+func parseRowValues(stored interface{}) (rowValues, error) {
+	if stored == nil {
+		return nil, nil
+	}
+
+	literals, err := parseLiterals(asString(stored))
+	if err != nil {
+		return nil, err
+	}
+	if len(literals)%2 != 0 {
+		return nil, fmt.Errorf("mismatched columns and values in %.100s", asString(stored))
+	}
+
+	row := make(rowValues, 0, len(literals)/2)
+	for i := 0; i < len(literals); i += 2 {
+		row = append(row, columnValue{Name: asString(literals[i]), Value: literals[i+1]})
+	}
+
+	return row, nil
+}
+
+func (v rowValues) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+
+	buf.WriteByte('{')
+	for i, column := range v {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		value := column.Value
+		switch typed := value.(type) {
+		case []byte:
+			value = map[string]string{"blob": hex.EncodeToString(typed)}
+		case float64:
+			if math.IsInf(typed, 0) {
+				value = strconv.FormatFloat(typed, 'g', -1, 64)
+			}
+		}
+
+		name, err := json.Marshal(column.Name)
+		if err != nil {
+			return nil, err
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(encoded)
+	}
+	buf.WriteByte('}')
+
+	return buf.Bytes(), nil
+}
+
+func asString(value interface{}) string {
+	switch typed := value.(type) {
+	case string:
+		return typed
+	case []byte:
+		return string(typed)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(typed)
+	}
+}
+
+func asInt64(value interface{}) int64 {
+	switch typed := value.(type) {
+	case int64:
+		return typed
+	case float64:
+		return int64(typed)
+	case string:
+		n, _ := strconv.ParseInt(typed, 10, 64)
+		return n
+	default:
+		return 0
+	}
+}
+
+type changeRecord struct {
+	Seq   int64     `json:"seq"`
+	Table string    `json:"table"`
+	Op    string    `json:"op"`
+	Key   rowValues `json:"key"`
+	Old   rowValues `json:"old,omitempty"`
+	New   rowValues `json:"new,omitempty"`
+	At    int64     `json:"at"`
+}
+
+type changesResponse struct {
+	Version uint64         `json:"version"`
+	Next    int64          `json:"next"`
+	More    bool           `json:"more"`
+	Changes []changeRecord `json:"changes"`
+}
+
+// serveChanges lists the row-level changes after since=<seq> in the current
+// snapshot. Clients pass back next as since to carry on from there, and can
+// follow /events to find out when to.
+func serveChanges(w http.ResponseWriter, r *http.Request, db *watchedDB, view replicaView) {
+	// the feed has changes to every table, row and column, which filters and
+	// redaction profiles can't be applied to after the fact
+	if !view.empty() {
+		http.Error(w, "change feed isn't available through a replication filter or redaction profile", 404)
+		return
+	}
+
+	current := db.acquireSnapshot()
+	if current == nil {
+		http.Error(w, "no snapshot available yet", 503)
+		return
+	}
+	defer current.release()
+
+	setVersionHeaders(w, current)
+
+	var since int64
+	if value := r.URL.Query().Get("since"); value != "" {
+		var err error
+		if since, err = strconv.ParseInt(value, 10, 64); err != nil || since < 0 {
+			http.Error(w, "invalid since", 400)
+			return
+		}
+	}
+
+	limit := 1000
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+			http.Error(w, "invalid limit", 400)
+			return
+		}
+		if limit > maxChangesPerRequest {
+			limit = maxChangesPerRequest
+		}
+	}
+
+	source, err := openDatabase(current.path)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer source.Close()
+
+	bounds, err := source.Query(fmt.Sprintf("SELECT MIN(seq) FROM %s", quoteIdentifier(changesTable)))
+	if err != nil {
+		if strings.Contains(err.Error(), "no such table") {
+			http.Error(w, "change feed isn't enabled for this database", 404)
+			return
+		}
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	if since > 0 && len(bounds) > 0 && bounds[0][0] != nil && asInt64(bounds[0][0]) > since+1 {
+		http.Error(w, "changes since that point have been trimmed, start over from a full copy", 410)
+		return
+	}
+
+	rows, err := source.Query(fmt.Sprintf("SELECT seq, tbl, op, row_key, old_values, new_values, at FROM %s WHERE seq > %d ORDER BY seq LIMIT %d",
+		quoteIdentifier(changesTable), since, limit+1))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	response := changesResponse{Version: current.version, Next: since, Changes: []changeRecord{}}
+	if len(rows) > limit {
+		rows = rows[:limit]
+		response.More = true
+	}
+
+	for _, row := range rows {
+		change := changeRecord{
+			Seq:   asInt64(row[0]),
+			Table: asString(row[1]),
+			Op:    asString(row[2]),
+			At:    asInt64(row[6]),
+		}
+
+		if change.Key, err = parseRowValues(row[3]); err == nil {
+			if change.Old, err = parseRowValues(row[4]); err == nil {
+				change.New, err = parseRowValues(row[5])
+			}
+		}
+		if err != nil {
+			log.Error("unable to read change %d of %s: %s", change.Seq, db.name, err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		response.Changes = append(response.Changes, change)
+		response.Next = change.Seq
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
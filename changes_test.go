@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestServedSnapshotsLeaveOutChangeFeed(t *testing.T) {
+	db, _ := watchTestDB(t, auditedSchema)
+
+	if err := db.maintainChangeFeed(WatchConfig{ChangeRetention: 10000}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.refreshSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	internal := "SELECT name FROM sqlite_master WHERE name LIKE '\\_watchdb\\_%' ESCAPE '\\' ORDER BY name"
+
+	base := db.acquireSnapshot()
+	defer base.release()
+
+	base_db, err := openDatabase(base.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer base_db.Close()
+
+	// /changes is still served from the watcher's own snapshot
+	if names := queryValues(t, base_db, internal); len(names) == 0 {
+		t.Fatal("change feed isn't in the watcher's snapshot")
+	}
+
+	served, err := db.acquireView(replicaView{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer served.release()
+
+	if served.path == base.path || served.version != base.version {
+		t.Fatalf("served %s at version %d for %s at version %d", served.path, served.version, base.path, base.version)
+	}
+
+	served_db, err := openDatabase(served.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer served_db.Close()
+
+	if names := queryValues(t, served_db, internal); len(names) > 0 {
+		t.Errorf("served snapshot has the change feed in it: %v", names)
+	}
+
+	// the DB's own triggers are still replicated
+	if triggers := queryValues(t, served_db, "SELECT name FROM sqlite_master WHERE type = 'trigger' ORDER BY name"); len(triggers) != 2 {
+		t.Errorf("served snapshot has triggers %v", triggers)
+	}
+}
+
+func TestSnapshotsWithoutChangeFeedAreServedAsIs(t *testing.T) {
+	db, _ := watchTestDB(t, auditedSchema)
+
+	if _, err := db.refreshSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	base := db.acquireSnapshot()
+	defer base.release()
+
+	served, err := db.acquireView(replicaView{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer served.release()
+
+	if served != base {
+		t.Error("snapshot without a change feed was copied to be served")
+	}
+}
@@ -1,11 +1,9 @@
 package main
 
 import (
-	"github.com/dkulchenko/watchdb/ssl"
 	"io/ioutil"
-	"os"
-	"path"
 	"strconv"
+	"strings"
 
 	yaml "gopkg.in/yaml.v2"
 )
@@ -14,19 +12,76 @@ type WatchConfig struct {
 	BindAddr string `yaml:"bind_addr,omitempty"`
 	BindPort string `yaml:"bind_port,omitempty"`
 
-	NoBackup bool `yaml:"no_backup,omitempty"`
+	NoBackup bool         `yaml:"no_backup,omitempty"`
+	Backups  BackupPolicy `yaml:"backups,omitempty"`
+
+	Archive ArchiveConfig `yaml:"archive,omitempty"`
+
+	// an archive a watcher keeps (a directory or s3://bucket/prefix), for
+	// syncers to bootstrap from while it can't be reached
+	BootstrapFrom string `yaml:"bootstrap_from,omitempty"`
+
+	S3 S3Config `yaml:"s3,omitempty"`
 
 	UseSSL        bool   `yaml:"use_ssl,omitempty"`
 	SSLKeyFile    string `yaml:"ssl_key_file,omitempty"`
 	SSLCertFile   string `yaml:"ssl_cert_file,omitempty"`
 	SkipSSLVerify bool   `yaml:"skip_ssl_verify,omitempty"`
 
-	AuthKey string `yaml:"auth_key,omitempty"`
+	// client certificates, checked against SSLClientCAFile by the watcher and
+	// presented by syncers
+	SSLClientCAFile   string `yaml:"ssl_client_ca_file,omitempty"`
+	SSLClientCertFile string `yaml:"ssl_client_cert_file,omitempty"`
+	SSLClientKeyFile  string `yaml:"ssl_client_key_file,omitempty"`
+
+	// what syncers trust the watcher's certificate by, instead of the
+	// system's CAs
+	SSLCAFile string `yaml:"ssl_ca_file,omitempty"`
+	SSLPin    string `yaml:"ssl_pin,omitempty"`
+
+	// what generated and issued certificates are for, and where the CA that
+	// issues them is kept
+	SSLHosts     []string `yaml:"ssl_hosts,omitempty"`
+	SSLValidDays int      `yaml:"ssl_valid_days,omitempty"`
+	CADir        string   `yaml:"ca_dir,omitempty"`
 
-	SyncFile   string `yaml:"sync_file,omitempty"`
-	RemoteConn string `yaml:"remote_conn,omitempty"`
+	AuthKey string     `yaml:"auth_key,omitempty"`
+	Keyring []Identity `yaml:"keyring,omitempty"`
+
+	SigningKeyFile   string `yaml:"signing_key_file,omitempty"`
+	VerifyKeyFile    string `yaml:"verify_key_file,omitempty"`
+	RequireSignature bool   `yaml:"require_signature,omitempty"`
+
+	DecryptKeyFile string `yaml:"decrypt_key_file,omitempty"`
+
+	SyncFile   string           `yaml:"sync_file,omitempty"`
+	Databases  []DatabaseConfig `yaml:"databases,omitempty"`
+	Dir        string           `yaml:"dir,omitempty"`
+	RemoteConn string           `yaml:"remote_conn,omitempty"`
 
 	SyncInterval int64 `yaml:"sync_interval,omitempty"`
+
+	// where a syncer serves its replicas' status, and how far behind they can
+	// be and still be healthy
+	StatusAddr string `yaml:"status_addr,omitempty"`
+	MaxLag     int64  `yaml:"max_lag,omitempty"`
+
+	SqliteBinary string `yaml:"sqlite_binary,omitempty"`
+
+	ChangeFeed      bool  `yaml:"change_feed,omitempty"`
+	ChangeRetention int64 `yaml:"change_retention,omitempty"`
+
+	Filter  string                       `yaml:"filter,omitempty"`
+	Filters map[string]ReplicationFilter `yaml:"filters,omitempty"`
+
+	Redaction  string                      `yaml:"redaction,omitempty"`
+	Redactions map[string]RedactionProfile `yaml:"redactions,omitempty"`
+
+	// where the config was loaded from, for reloading the keyring
+	ConfigFile string `yaml:"-"`
+
+	// whether the watcher's certificate was generated, and is renewed by it
+	GeneratedCert bool `yaml:"-"`
 }
 
 func loadConfig(arguments map[string]interface{}) WatchConfig {
@@ -37,6 +92,12 @@ func loadConfig(arguments map[string]interface{}) WatchConfig {
 		UseSSL:        false,
 		SkipSSLVerify: false,
 		SyncInterval:  1000,
+		MaxLag:        defaultMaxLag,
+		SSLValidDays:  365,
+
+		Backups: BackupPolicy{Keep: 1},
+
+		ChangeRetention: 10000,
 	}
 
 	config_file, ok := arguments["--config-file"].(string)
@@ -51,6 +112,7 @@ func loadConfig(arguments map[string]interface{}) WatchConfig {
 			log.Fatalf("error reading config file: %v", err)
 		}
 
+		initialConfig.ConfigFile = config_file
 		log.Notice("config file loaded")
 	}
 
@@ -62,8 +124,25 @@ func loadConfig(arguments map[string]interface{}) WatchConfig {
 		initialConfig.BindPort = bindport
 	}
 
-	if nobackup, ok := arguments["--bind-port"].(bool); ok {
-		initialConfig.NoBackup = nobackup
+	if nobackup, ok := arguments["--no-backup"].(bool); ok && nobackup {
+		initialConfig.NoBackup = true
+	}
+
+	if archive, ok := arguments["--archive"].(bool); ok && archive {
+		initialConfig.Archive.Enabled = true
+	}
+
+	if archiveto, ok := arguments["--archive-to"].(string); ok {
+		initialConfig.Archive.Enabled = true
+		initialConfig.Archive.Dir = archiveto
+	}
+
+	if bootstrapfrom, ok := arguments["--bootstrap-from"].(string); ok {
+		initialConfig.BootstrapFrom = bootstrapfrom
+	}
+
+	if s3endpoint, ok := arguments["--s3-endpoint"].(string); ok {
+		initialConfig.S3.Endpoint = s3endpoint
 	}
 
 	if usessl, ok := arguments["--ssl"].(bool); ok {
@@ -82,10 +161,90 @@ func loadConfig(arguments map[string]interface{}) WatchConfig {
 		initialConfig.SkipSSLVerify = skipsslverify
 	}
 
+	if sslclientca, ok := arguments["--ssl-client-ca"].(string); ok {
+		initialConfig.SSLClientCAFile = sslclientca
+	}
+
+	if sslclientcert, ok := arguments["--ssl-client-cert"].(string); ok {
+		initialConfig.SSLClientCertFile = sslclientcert
+	}
+
+	if sslclientkey, ok := arguments["--ssl-client-key"].(string); ok {
+		initialConfig.SSLClientKeyFile = sslclientkey
+	}
+
+	if sslca, ok := arguments["--ssl-ca"].(string); ok {
+		initialConfig.SSLCAFile = sslca
+	}
+
+	if sslpin, ok := arguments["--ssl-pin"].(string); ok {
+		initialConfig.SSLPin = sslpin
+	}
+
+	if sslhosts, ok := arguments["--host"].(string); ok {
+		initialConfig.SSLHosts = strings.Split(sslhosts, ",")
+	}
+
+	if validdays, ok := arguments["--valid-days"].(string); ok {
+		days, err := strconv.Atoi(validdays)
+
+		if err == nil && days > 0 {
+			initialConfig.SSLValidDays = days
+		}
+	}
+
+	if cadir, ok := arguments["--ca-dir"].(string); ok {
+		initialConfig.CADir = cadir
+	}
+
 	if authkey, ok := arguments["--auth-key"].(string); ok {
 		initialConfig.AuthKey = authkey
 	}
 
+	if signingkey, ok := arguments["--signing-key"].(string); ok {
+		initialConfig.SigningKeyFile = signingkey
+	}
+
+	if verifykey, ok := arguments["--verify-key"].(string); ok {
+		initialConfig.VerifyKeyFile = verifykey
+	}
+
+	if requiresignature, ok := arguments["--require-signature"].(bool); ok && requiresignature {
+		initialConfig.RequireSignature = true
+	}
+
+	if decryptkey, ok := arguments["--decrypt-key"].(string); ok {
+		initialConfig.DecryptKeyFile = decryptkey
+	}
+
+	if sqlitebinary, ok := arguments["--sqlite-binary"].(string); ok {
+		initialConfig.SqliteBinary = sqlitebinary
+	}
+
+	if changefeed, ok := arguments["--change-feed"].(bool); ok && changefeed {
+		initialConfig.ChangeFeed = true
+	}
+
+	if changeretention, ok := arguments["--change-retention"].(string); ok {
+		retention, err := strconv.ParseInt(changeretention, 10, 64)
+
+		if err == nil && retention > 0 {
+			initialConfig.ChangeRetention = retention
+		}
+	}
+
+	if statusaddr, ok := arguments["--status-addr"].(string); ok {
+		initialConfig.StatusAddr = statusaddr
+	}
+
+	if maxlag, ok := arguments["--max-lag"].(string); ok {
+		lag, err := strconv.ParseInt(maxlag, 10, 64)
+
+		if err == nil && lag > 0 {
+			initialConfig.MaxLag = lag
+		}
+	}
+
 	if syncinterval, ok := arguments["--sync-interval"].(string); ok {
 		interval, err := strconv.ParseInt(syncinterval, 10, 32)
 
@@ -94,8 +253,26 @@ func loadConfig(arguments map[string]interface{}) WatchConfig {
 		}
 	}
 
-	if syncfile, ok := arguments["<db.sql>"].(string); ok {
-		initialConfig.SyncFile = syncfile
+	// databases on the command line replace any in the config file
+	if dbargs, ok := arguments["<db.sql>"].([]string); ok && len(dbargs) > 0 {
+		initialConfig.Databases = nil
+		for _, dbarg := range dbargs {
+			initialConfig.Databases = append(initialConfig.Databases, parseDatabaseArg(dbarg))
+		}
+	} else if len(initialConfig.Databases) == 0 && initialConfig.SyncFile != "" {
+		initialConfig.Databases = []DatabaseConfig{{Path: initialConfig.SyncFile}}
+	}
+
+	if dir, ok := arguments["--dir"].(string); ok {
+		initialConfig.Dir = dir
+	}
+
+	if seed, ok := arguments["--seed"].(string); ok {
+		if len(initialConfig.Databases) != 1 {
+			log.Fatal("--seed is for one database, give each its own seed in the config file")
+		}
+
+		initialConfig.Databases[0].Seed = seed
 	}
 
 	if remoteconn, ok := arguments["<remote>"].(string); ok {
@@ -105,13 +282,13 @@ func loadConfig(arguments map[string]interface{}) WatchConfig {
 	watch, ok := arguments["watch"].(bool)
 
 	if watch && initialConfig.UseSSL && (initialConfig.SSLKeyFile == "" || initialConfig.SSLCertFile == "") {
-		log.Warning("ssl cert file and key file weren't specified, automatically generating")
-		ssl.GenerateSelfSignedCerts()
+		cert_path, key_path, err := ensureSelfSignedCert(initialConfig)
+		if err != nil {
+			log.Fatalf("unable to generate certificate: %s", err)
+		}
 
-		homedir := os.Getenv("HOME")
-		watchdb_dir := path.Join(homedir, ".config", "watchdb")
-		initialConfig.SSLCertFile = path.Join(watchdb_dir, "watchdb-cert.pem")
-		initialConfig.SSLKeyFile = path.Join(watchdb_dir, "watchdb-key.pem")
+		initialConfig.SSLCertFile, initialConfig.SSLKeyFile = cert_path, key_path
+		initialConfig.GeneratedCert = true
 	}
 
 	return initialConfig
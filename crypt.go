@@ -0,0 +1,369 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Payloads can be encrypted for the replica they're sent to, so they stay
+// confidential through relays and caches that TLS doesn't reach. Each
+// response is compressed, then encrypted with a key agreed between a one-off
+// X25519 key (sent ahead of the payload) and the replica's recipient key, in
+// chunks sealed with AES-256-GCM. Every chunk's nonce holds its position and
+// whether it's the last one, so chunks can't be reordered, dropped or cut
+// off without it being noticed.
+const encryptionScheme = "x25519-aes256gcm-gzip"
+
+const encryptChunkSize = 64 * 1024
+
+// set on the length of the last chunk
+const finalChunk = 1 << 31
+
+var errNotEncrypted = syncFailure("decryption", "upstream didn't encrypt the response")
+var errTruncatedPayload = syncFailure("decryption", "truncated encrypted payload from upstream")
+var errInvalidChunk = syncFailure("decryption", "invalid chunk in encrypted payload from upstream")
+var errUndecryptable = syncFailure("decryption", "unable to decrypt payload from upstream, it isn't for this decrypt key or was tampered with")
+var errTrailingData = syncFailure("decryption", "unexpected data after encrypted payload from upstream")
+
+// set from --decrypt-key when syncing
+var decrypt_key *ecdh.PrivateKey
+
+func parseRecipient(recipient string) (*ecdh.PublicKey, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(recipient))
+	if err != nil {
+		return nil, fmt.Errorf("recipient isn't base64: %s", err)
+	}
+
+	return ecdh.X25519().NewPublicKey(data)
+}
+
+func payloadKey(shared []byte, ephemeral []byte, recipient []byte) []byte {
+	mac := hmac.New(sha256.New, shared)
+	mac.Write([]byte("watchdb-payload-v1"))
+	mac.Write(ephemeral)
+	mac.Write(recipient)
+	return mac.Sum(nil)
+}
+
+func payloadCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(counter uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptWriter encrypts everything written to it for one recipient, and has
+// to be closed to seal the last chunk
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+}
+
+func newEncryptWriter(w io.Writer, recipient *ecdh.PublicKey) (*encryptWriter, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := payloadCipher(payloadKey(shared, ephemeral.PublicKey().Bytes(), recipient.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(ephemeral.PublicKey().Bytes()); err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{w: w, aead: aead}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	e.buf = append(e.buf, p...)
+
+	// a full chunk is only sealed once there's more after it, since the last
+	// one is sealed differently
+	for len(e.buf) > encryptChunkSize {
+		if err := e.seal(e.buf[:encryptChunkSize], false); err != nil {
+			return 0, err
+		}
+		e.buf = e.buf[encryptChunkSize:]
+	}
+
+	return len(p), nil
+}
+
+func (e *encryptWriter) Close() error {
+	err := e.seal(e.buf, true)
+	e.buf = nil
+	return err
+}
+
+func (e *encryptWriter) seal(chunk []byte, final bool) error {
+	sealed := e.aead.Seal(nil, chunkNonce(e.counter, final), chunk, nil)
+	e.counter++
+
+	length := uint32(len(sealed))
+	if final {
+		length |= finalChunk
+	}
+
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, length)
+
+	if _, err := e.w.Write(header); err != nil {
+		return err
+	}
+
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// decryptReader decrypts a payload encrypted for key, returning EOF only
+// once its last chunk has been read
+type decryptReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+	done    bool
+}
+
+func newDecryptReader(r io.Reader, key *ecdh.PrivateKey) (*decryptReader, error) {
+	ephemeral := make([]byte, 32)
+	if _, err := io.ReadFull(r, ephemeral); err != nil {
+		return nil, errTruncatedPayload
+	}
+
+	public_key, err := ecdh.X25519().NewPublicKey(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := key.ECDH(public_key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := payloadCipher(payloadKey(shared, ephemeral, key.PublicKey().Bytes()))
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptReader{r: r, aead: aead}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+func (d *decryptReader) open() error {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(d.r, header); err != nil {
+		return errTruncatedPayload
+	}
+
+	length := binary.BigEndian.Uint32(header)
+	final := length&finalChunk != 0
+	length &^= finalChunk
+
+	if length > encryptChunkSize+uint32(d.aead.Overhead()) {
+		return errInvalidChunk
+	}
+
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		return errTruncatedPayload
+	}
+
+	chunk, err := d.aead.Open(nil, chunkNonce(d.counter, final), sealed, nil)
+	if err != nil {
+		return errUndecryptable
+	}
+	d.counter++
+
+	d.buf = chunk
+
+	if final {
+		d.done = true
+
+		// the response has to end here, which is also what gets its
+		// trailers read
+		if n, _ := io.Copy(ioutil.Discard, d.r); n > 0 {
+			return errTrailingData
+		}
+	}
+
+	return nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// stackedWriteCloser closes a compressor before what it writes to
+type stackedWriteCloser struct {
+	io.Writer
+	closers []io.Closer
+}
+
+func (s stackedWriteCloser) Close() error {
+	for _, closer := range s.closers {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeResponse returns where the body of a response to client goes:
+// encrypted for it if it has a recipient key, or gzipped if it accepts that.
+// It has to be closed once the body has been written.
+func encodeResponse(w http.ResponseWriter, r *http.Request, client *Identity, dest io.Writer) (io.WriteCloser, error) {
+	if client != nil && client.Recipient != "" {
+		recipient, err := parseRecipient(client.Recipient)
+		if err != nil {
+			return nil, err
+		}
+
+		w.Header().Set("X-Watchdb-Encryption", encryptionScheme)
+
+		enc, err := newEncryptWriter(dest, recipient)
+		if err != nil {
+			return nil, err
+		}
+
+		gz := gzip.NewWriter(enc)
+		return stackedWriteCloser{Writer: gz, closers: []io.Closer{gz, enc}}, nil
+	}
+
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+
+		gz := gzip.NewWriter(dest)
+		return stackedWriteCloser{Writer: gz, closers: []io.Closer{gz}}, nil
+	}
+
+	return nopWriteCloser{dest}, nil
+}
+
+// decodeResponse returns the body of a response from upstream, decrypted if
+// it was encrypted. With a decrypt key, responses that weren't encrypted are
+// refused.
+func decodeResponse(resp *http.Response) (io.Reader, error) {
+	scheme := resp.Header.Get("X-Watchdb-Encryption")
+
+	if scheme == "" {
+		if decrypt_key != nil {
+			return nil, errNotEncrypted
+		}
+		return resp.Body, nil
+	}
+
+	if scheme != encryptionScheme {
+		return nil, syncFailure("decryption", "upstream encrypted the response with an unknown scheme '%s'", scheme)
+	}
+
+	if decrypt_key == nil {
+		return nil, syncFailure("decryption", "upstream encrypted the response, a --decrypt-key is needed to sync")
+	}
+
+	dec, err := newDecryptReader(resp.Body, decrypt_key)
+	if err != nil {
+		return nil, err
+	}
+
+	return gzip.NewReader(dec)
+}
+
+func loadDecryptKey(path string) (*ecdh.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s isn't a PEM file", path)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	private_key, ok := key.(*ecdh.PrivateKey)
+	if !ok || private_key.Curve() != ecdh.X25519() {
+		return nil, fmt.Errorf("%s isn't an X25519 private key", path)
+	}
+
+	return private_key, nil
+}
+
+// generateDecryptKey writes a new X25519 key to path (for the syncer), and
+// returns the recipient key the watcher encrypts for
+func generateDecryptKey(path string) (string, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	err = ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// encryptedPayload is an encrypted payload split into its parts, so they can
+// be tampered with
+type encryptedPayload struct {
+	ephemeral []byte
+	chunks    [][]byte // each with its length header
+}
+
+func encryptPayload(t *testing.T, key *ecdh.PrivateKey, payload []byte) encryptedPayload {
+	var out bytes.Buffer
+
+	enc, err := newEncryptWriter(&out, key.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := enc.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data := out.Bytes()
+	encrypted := encryptedPayload{ephemeral: data[:32]}
+
+	for rest := data[32:]; len(rest) > 0; {
+		length := 4 + int(binary.BigEndian.Uint32(rest[:4])&^finalChunk)
+		encrypted.chunks = append(encrypted.chunks, rest[:length])
+		rest = rest[length:]
+	}
+
+	return encrypted
+}
+
+func (e encryptedPayload) bytes() []byte {
+	data := append([]byte{}, e.ephemeral...)
+	for _, chunk := range e.chunks {
+		data = append(data, chunk...)
+	}
+	return data
+}
+
+func (e encryptedPayload) withChunks(chunks ...[]byte) encryptedPayload {
+	return encryptedPayload{ephemeral: e.ephemeral, chunks: chunks}
+}
+
+func withFinalFlag(chunk []byte, final bool) []byte {
+	chunk = append([]byte{}, chunk...)
+
+	length := binary.BigEndian.Uint32(chunk[:4]) &^ finalChunk
+	if final {
+		length |= finalChunk
+	}
+	binary.BigEndian.PutUint32(chunk[:4], length)
+
+	return chunk
+}
+
+func decryptPayload(key *ecdh.PrivateKey, data []byte) ([]byte, error) {
+	dec, err := newDecryptReader(bytes.NewReader(data), key)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(dec)
+}
+
+func generateTestDecryptKey(t *testing.T) *ecdh.PrivateKey {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func TestEncryptedPayloadRoundTrip(t *testing.T) {
+	key := generateTestDecryptKey(t)
+
+	for _, size := range []int{0, 1, encryptChunkSize - 1, encryptChunkSize, encryptChunkSize + 1, 3*encryptChunkSize + 100} {
+		payload := make([]byte, size)
+		rand.Read(payload)
+
+		// an empty payload still has its last chunk
+		chunks := (size + encryptChunkSize - 1) / encryptChunkSize
+		if chunks == 0 {
+			chunks = 1
+		}
+
+		encrypted := encryptPayload(t, key, payload)
+		if len(encrypted.chunks) != chunks {
+			t.Errorf("%d byte payload sealed in %d chunks", size, len(encrypted.chunks))
+		}
+
+		decrypted, err := decryptPayload(key, encrypted.bytes())
+		if err != nil {
+			t.Errorf("%d byte payload: %s", size, err)
+		} else if !bytes.Equal(decrypted, payload) {
+			t.Errorf("%d byte payload came back different", size)
+		}
+	}
+}
+
+func TestEncryptedPayloadTampering(t *testing.T) {
+	key := generateTestDecryptKey(t)
+
+	payload := make([]byte, 2*encryptChunkSize+100)
+	rand.Read(payload)
+
+	encrypted := encryptPayload(t, key, payload)
+	first, second, last := encrypted.chunks[0], encrypted.chunks[1], encrypted.chunks[2]
+	data := encrypted.bytes()
+
+	flipped := append([]byte{}, second...)
+	flipped[100] ^= 1
+
+	oversized := append([]byte{}, second...)
+	binary.BigEndian.PutUint32(oversized[:4], encryptChunkSize+1000)
+
+	for _, test := range []struct {
+		name string
+		data []byte
+		key  *ecdh.PrivateKey
+		err  error
+	}{
+		{"missing ephemeral key", data[:20], key, errTruncatedPayload},
+		{"cut off in a chunk header", data[:32+len(first)+2], key, errTruncatedPayload},
+		{"cut off in a chunk", data[:len(data)-10], key, errTruncatedPayload},
+		{"last chunk dropped", encrypted.withChunks(first, second).bytes(), key, errTruncatedPayload},
+		{"chunk dropped", encrypted.withChunks(first, last).bytes(), key, errUndecryptable},
+		{"chunks reordered", encrypted.withChunks(second, first, last).bytes(), key, errUndecryptable},
+		{"chunk repeated", encrypted.withChunks(first, first, second, last).bytes(), key, errUndecryptable},
+		{"earlier chunk flagged final", encrypted.withChunks(first, withFinalFlag(second, true)).bytes(), key, errUndecryptable},
+		{"last chunk not flagged final", encrypted.withChunks(first, second, withFinalFlag(last, false)).bytes(), key, errUndecryptable},
+		{"chunk modified", encrypted.withChunks(first, flipped, last).bytes(), key, errUndecryptable},
+		{"oversized chunk", encrypted.withChunks(first, oversized, last).bytes(), key, errInvalidChunk},
+		{"data after last chunk", append(encrypted.bytes(), "extra"...), key, errTrailingData},
+		{"wrong key", data, generateTestDecryptKey(t), errUndecryptable},
+	} {
+		if _, err := decryptPayload(test.key, test.data); err != test.err {
+			t.Errorf("%s: expected %q, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestDecodeResponse(t *testing.T) {
+	key := generateTestDecryptKey(t)
+	recipient := base64.StdEncoding.EncodeToString(key.PublicKey().Bytes())
+
+	defer func() {
+		decrypt_key = nil
+	}()
+
+	serve := func(client *Identity) *http.Response {
+		req := httptest.NewRequest("GET", "/latest", nil)
+		rec := httptest.NewRecorder()
+
+		body, err := encodeResponse(rec, req, client, rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body.Write([]byte("CREATE TABLE t(x);\n"))
+		body.Close()
+
+		return rec.Result()
+	}
+
+	decrypt_key = key
+
+	body, err := decodeResponse(serve(&Identity{Name: "syncer", Recipient: recipient}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadAll(body); err != nil || string(data) != "CREATE TABLE t(x);\n" {
+		t.Errorf("encrypted response decoded to %q (%v)", data, err)
+	}
+
+	// with a decrypt key, the watcher has to encrypt what it sends
+	if _, err := decodeResponse(serve(nil)); err != errNotEncrypted {
+		t.Errorf("expected %q for a response that wasn't encrypted, got %v", errNotEncrypted, err)
+	}
+
+	decrypt_key = nil
+
+	if _, err := decodeResponse(serve(&Identity{Name: "syncer", Recipient: recipient})); err == nil || failureReason(err) != "decryption" {
+		t.Errorf("encrypted response decoded without a decrypt key (%v)", err)
+	}
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/howeyc/fsnotify"
+)
+
+// DatabaseConfig is one DB to watch or sync. When watching, Name is the
+// route it's served under (/db/<name>/...) and defaults to the file name
+// without its extension. When syncing, Name is the upstream DB to follow; if
+// it's empty the watcher's only DB is synced. Filter and Redaction name the
+// replication filter and redaction profile applied to everything served from
+// the DB. Seed is a copy made with watchdb snapshot that a new replica starts
+// from.
+type DatabaseConfig struct {
+	Name      string `yaml:"name,omitempty"`
+	Path      string `yaml:"path"`
+	Filter    string `yaml:"filter,omitempty"`
+	Redaction string `yaml:"redaction,omitempty"`
+	Seed      string `yaml:"seed,omitempty"`
+}
+
+// parseDatabaseArg reads a DB given on the command line, either as a plain
+// path or as name=path
+func parseDatabaseArg(arg string) DatabaseConfig {
+	if i := strings.Index(arg, "="); i > 0 {
+		return DatabaseConfig{Name: arg[:i], Path: arg[i+1:]}
+	}
+
+	return DatabaseConfig{Path: arg}
+}
+
+func defaultDatabaseName(path string) string {
+	base := filepath.Base(path)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+func validDatabaseName(name string) bool {
+	if name == "" || strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") {
+		return false
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+
+	return true
+}
+
+// watchedDB is a DB being served to syncers, along with everything needed to
+// notice its changes and keep its snapshot current
+type watchedDB struct {
+	name string
+	path string
+
+	// found by watching a directory rather than asked for by name
+	discovered bool
+
+	// replication filter and redaction profile for every client, instead of
+	// the default ones
+	filter    string
+	redaction string
+
+	subscribers *hub
+
+	snapshot_lock  sync.Mutex
+	snapshot       *snapshot
+	snapshot_count int
+
+	wal          *walState
+	db_md5       string
+	needs_update chan bool
+	stopped      chan bool
+
+	// deleted or moved away, and waiting for a replacement to show up
+	missing bool
+
+	// schema the change feed triggers were last installed for
+	feed_schema string
+
+	// newest version in the archive, guarded by archive_lock
+	archived_version uint64
+}
+
+func newWatchedDB(name string, path string) *watchedDB {
+	return &watchedDB{
+		name:         name,
+		path:         filepath.Clean(path),
+		subscribers:  newHub(),
+		wal:          &walState{},
+		needs_update: make(chan bool, 1),
+		stopped:      make(chan bool),
+	}
+}
+
+func (db *watchedDB) walPath() string {
+	return db.path + "-wal"
+}
+
+func (db *watchedDB) shmPath() string {
+	return db.path + "-shm"
+}
+
+// start takes the first snapshot of the DB and begins picking up its changes
+func (db *watchedDB) start(fw *fileWatcher, options WatchConfig) error {
+	// in WAL mode commits land in the -wal file and the main DB only changes
+	// on checkpoint, so committed WAL frames are part of the checksum
+	if _, err := db.wal.update(db.walPath()); err != nil {
+		log.Warning("unable to read WAL for %s: %s", db.name, err)
+	}
+
+	if isWALMode(db.path) {
+		log.Info("%s is in WAL mode, watching %s for commits", db.name, db.walPath())
+	}
+
+	if options.ChangeFeed {
+		if err := db.maintainChangeFeed(options); err != nil {
+			log.Warning("unable to set up change feed for %s: %s", db.name, err)
+		}
+	}
+
+	db_md5, err := getMD5(db.path)
+	if err != nil {
+		return err
+	}
+	db.db_md5 = db_md5 + db.wal.fingerprint()
+
+	if _, err := db.refreshSnapshot(); err != nil {
+		return err
+	}
+
+	current := db.acquireSnapshot()
+	log.Info("watched DB %s is at version %d", db.name, current.version)
+	current.release()
+
+	if err := fw.add(db.path, db.handleEvent); err != nil {
+		db.dropSnapshot()
+		return err
+	}
+
+	go db.update(options)
+	go db.archive(options)
+
+	log.Notice("watching %s as %s", db.path, db.name)
+
+	return nil
+}
+
+// stop stops watching the DB and cleans up its snapshot
+func (db *watchedDB) stop(fw *fileWatcher) {
+	fw.remove(db.path)
+	close(db.stopped)
+	db.dropSnapshot()
+}
+
+func (db *watchedDB) queueUpdate() {
+	select {
+	case db.needs_update <- true:
+		// queued successfully
+	default:
+		// request is already in line, don't queue another one
+	}
+}
+
+func (db *watchedDB) update(options WatchConfig) {
+	for {
+		select {
+		case <-db.needs_update:
+		case <-db.stopped:
+			return
+		}
+
+		committed, err := db.wal.update(db.walPath())
+		if err != nil {
+			log.Warning("unable to read WAL for %s: %s", db.name, err)
+		} else if committed {
+			log.Debug("new transaction committed to WAL of %s (%d commits since last checkpoint)", db.name, db.wal.commits)
+		}
+
+		// a new DB that's still being created, which gets another event
+		// once it's written to; reading it now would only get in the way
+		if info, err := os.Stat(db.path); err == nil && info.Size() == 0 {
+			continue
+		}
+
+		// new tables (or columns) need triggers before their changes show up
+		// in the feed
+		if options.ChangeFeed {
+			if err := db.maintainChangeFeed(options); err != nil {
+				log.Warning("unable to update change feed for %s: %s", db.name, err)
+			}
+		}
+
+		new_md5, err := getMD5(db.path)
+		if err != nil {
+			// most likely deleted, which is handled once the event arrives
+			log.Warning("unable to read %s: %s", db.name, err)
+			continue
+		}
+
+		new_md5 += db.wal.fingerprint()
+		if db.db_md5 == new_md5 {
+			log.Debug("watched DB %s was modified, but checksum is the same, not notifying clients", db.name)
+		} else {
+			changed, err := db.refreshSnapshot()
+			if err != nil {
+				log.Warning("unable to snapshot %s, retrying: %s", db.name, err)
+
+				time.Sleep(time.Duration(options.SyncInterval) * time.Millisecond)
+				db.queueUpdate()
+				continue
+			}
+
+			db.db_md5 = new_md5
+
+			current := db.acquireSnapshot()
+			version := current.version
+			current.release()
+
+			if !changed {
+				log.Debug("watched DB %s was modified, but contents are the same, not notifying clients", db.name)
+			} else if db.subscribers.Len() < 1 {
+				log.Info("watched DB %s was modified (version %d), but no clients to notify", db.name, version)
+			} else {
+				log.Info("watched DB %s was modified (version %d), notifying connected clients (%d)", db.name, version, db.subscribers.Len())
+				metricNotifications.add(float64(db.subscribers.broadcast("change")), db.name)
+			}
+
+			if changed {
+				metricChanges.inc(db.name)
+				go db.archive(options)
+			}
+		}
+
+		time.Sleep(time.Duration(options.SyncInterval) * time.Millisecond)
+	}
+}
+
+func (db *watchedDB) handleEvent(ev *fsnotify.FileEvent) {
+	name := filepath.Clean(ev.Name)
+
+	if name == db.walPath() || name == db.shmPath() {
+		if ev.IsCreate() || ev.IsModify() || ev.IsDelete() {
+			db.queueUpdate()
+		}
+		return
+	}
+
+	if ev.IsDelete() || ev.IsRename() {
+		// tools that write atomically rename a new file over the old one,
+		// which is only a delete as far as the old file is concerned
+		if db_exists, _ := exists(db.path); db_exists {
+			db.replaced()
+			return
+		}
+
+		if db.discovered {
+			// it'll be picked up again under its new name if it's still in the
+			// watched directory
+			log.Info("watched DB %s was deleted or moved, no longer serving it", db.name)
+			databases.remove(db.name)
+			return
+		}
+
+		// the watch would otherwise follow the file to wherever it was moved
+		databases.watcher.unwatchFile(db.path)
+
+		if !db.missing {
+			db.missing = true
+			log.Warning("watched DB %s was deleted or moved away, serving the last snapshot until %s is back", db.name, db.path)
+		}
+		return
+	}
+
+	if ev.IsCreate() {
+		db.replaced()
+		return
+	}
+
+	if ev.IsModify() {
+		db.queueUpdate()
+	}
+}
+
+// replaced starts following a new file at the DB's path, which may be a
+// different file than the one that was there before
+func (db *watchedDB) replaced() {
+	if err := databases.watcher.rewatchFile(db.path); err != nil {
+		log.Warning("unable to watch replacement of %s: %s", db.name, err)
+	}
+
+	if db.missing {
+		db.missing = false
+		log.Notice("watched DB %s is back at %s", db.name, db.path)
+	} else {
+		log.Info("watched DB %s was replaced", db.name)
+	}
+
+	db.queueUpdate()
+}
+
+// registry is the set of DBs being served, by name
+type registry struct {
+	mu        sync.Mutex
+	watcher   *fileWatcher
+	databases map[string]*watchedDB
+
+	// names of DBs that are still starting, by path
+	starting map[string]string
+}
+
+var databases = &registry{databases: make(map[string]*watchedDB), starting: make(map[string]string)}
+
+// add starts serving a DB. Starting it takes a snapshot, which can take a
+// while for a large DB, so its name is only reserved in the meantime rather
+// than holding up requests for the others.
+func (r *registry) add(db *watchedDB, options WatchConfig) error {
+	if err := r.reserve(db); err != nil {
+		return err
+	}
+
+	err := db.start(r.watcher, options)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.starting, db.name)
+	if err != nil {
+		return err
+	}
+
+	r.databases[db.name] = db
+
+	return nil
+}
+
+func (r *registry) reserve(db *watchedDB) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !validDatabaseName(db.name) {
+		return fmt.Errorf("invalid DB name '%s'", db.name)
+	}
+
+	if existing, ok := r.databases[db.name]; ok {
+		return fmt.Errorf("%s and %s are both named '%s', give one a different name with name=path", existing.path, db.path, db.name)
+	}
+	if existing, ok := r.starting[db.name]; ok {
+		return fmt.Errorf("%s and %s are both named '%s', give one a different name with name=path", existing, db.path, db.name)
+	}
+
+	r.starting[db.name] = db.path
+
+	return nil
+}
+
+// remove stops serving a DB
+func (r *registry) remove(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	db, ok := r.databases[name]
+	if !ok {
+		return
+	}
+
+	delete(r.databases, name)
+	db.stop(r.watcher)
+}
+
+// removeUnder stops serving every DB inside dir
+func (r *registry) removeUnder(dir string) {
+	prefix := filepath.Clean(dir) + string(filepath.Separator)
+
+	for _, db := range r.list() {
+		if strings.HasPrefix(db.path, prefix) {
+			log.Info("watched DB %s is no longer in the watched directory, no longer serving it", db.name)
+			r.remove(db.name)
+		}
+	}
+}
+
+// isStarting says whether the DB at path is still being started
+func (r *registry) isStarting(path string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	path = filepath.Clean(path)
+	for _, starting := range r.starting {
+		if starting == path {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *registry) byPath(path string) *watchedDB {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	path = filepath.Clean(path)
+	for _, db := range r.databases {
+		if db.path == path {
+			return db
+		}
+	}
+
+	return nil
+}
+
+func (r *registry) get(name string) *watchedDB {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.databases[name]
+}
+
+// only returns the DB being served if there's exactly one, for requests to
+// the unnamed routes
+func (r *registry) only() *watchedDB {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.databases) != 1 {
+		return nil
+	}
+
+	for _, db := range r.databases {
+		return db
+	}
+
+	return nil
+}
+
+func (r *registry) list() []*watchedDB {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := make([]*watchedDB, 0, len(r.databases))
+	for _, db := range r.databases {
+		list = append(list, db)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].name < list[j].name
+	})
+
+	return list
+}
+
+func (r *registry) subscriberCount() int {
+	count := 0
+	for _, db := range r.list() {
+		count += db.subscribers.Len()
+	}
+
+	return count
+}
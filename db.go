@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// Database is everything watchdb needs to do with a sqlite database. It's
+// implemented in-process by the sqlite driver when watchdb is built with
+// cgo, and by shelling out to a sqlite3 binary otherwise (or when one is
+// explicitly requested with --sqlite-binary).
+type Database interface {
+	// Dump writes the database out as a SQL script
+	Dump(w io.Writer) error
+
+	// Restore runs a SQL script (such as a dump) against a new, empty database
+	Restore(r io.Reader) error
+
+	// Backup writes a consistent copy of the database to dest
+	Backup(dest string) error
+
+	// Exec runs a SQL script against the database
+	Exec(script string) error
+
+	// Query runs a single query, returning the values of each row as nil,
+	// int64, float64, string or []byte
+	Query(query string) ([][]interface{}, error)
+
+	IntegrityCheck() error
+	Close() error
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+func quoteLiteral(value string) string {
+	return "'" + strings.Replace(value, "'", "''", -1) + "'"
+}
+
+// quoteArgument quotes an argument to a sqlite3 shell dot-command, which
+// takes backslash escapes inside double quotes but nothing inside single ones
+func quoteArgument(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
+
+func openDatabase(path string) (Database, error) {
+	if sqlite_path != "" {
+		return &execDatabase{path: path, binary: sqlite_path}, nil
+	}
+
+	return openDriverDatabase(path)
+}
+
+// setupSqlite decides between the built-in driver and an external sqlite3
+// binary, unpacking or locating the latter if needed
+func setupSqlite(options WatchConfig) {
+	switch {
+	case options.SqliteBinary == "auto" || (options.SqliteBinary == "" && !haveDriver):
+		sqlite_path = determineSqlitePath()
+	case options.SqliteBinary != "":
+		if binary_exists, _ := exists(options.SqliteBinary); !binary_exists {
+			log.Fatalf("sqlite3 binary %s not found", options.SqliteBinary)
+		}
+
+		log.Debug("using sqlite3 binary: %s", options.SqliteBinary)
+		sqlite_path = options.SqliteBinary
+	default:
+		log.Debug("using built-in sqlite driver")
+	}
+}
+
+type execDatabase struct {
+	path   string
+	binary string
+}
+
+func (d *execDatabase) run(stdin io.Reader, stdout io.Writer, args ...string) error {
+	var stderr bytes.Buffer
+
+	cmd := exec.Command(d.binary, append([]string{"-bail", "-cmd", ".timeout 5000", d.path}, args...)...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if stderr.Len() > 0 {
+			return fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return err
+	}
+
+	// the sqlite3 shell doesn't always exit non-zero on failed statements
+	if stderr.Len() > 0 {
+		return fmt.Errorf("%s", strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+func (d *execDatabase) Dump(w io.Writer) error {
+	return d.run(nil, w, ".dump")
+}
+
+func (d *execDatabase) Restore(r io.Reader) error {
+	return d.run(r, nil)
+}
+
+func (d *execDatabase) Backup(dest string) error {
+	return d.run(nil, nil, ".backup "+quoteArgument(dest))
+}
+
+func (d *execDatabase) Exec(script string) error {
+	return d.run(strings.NewReader(script), nil)
+}
+
+func (d *execDatabase) Query(query string) ([][]interface{}, error) {
+	var out bytes.Buffer
+	if err := d.run(strings.NewReader(".mode json\n"+query+";\n"), &out); err != nil {
+		return nil, err
+	}
+
+	// rows come out as an array of objects, which is read token by token to
+	// keep the columns in order
+	decoder := json.NewDecoder(&out)
+	decoder.UseNumber()
+
+	var rows [][]interface{}
+	var row []interface{}
+	depth := 0
+	is_key := false
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch value := token.(type) {
+		case json.Delim:
+			switch value {
+			case '[', '{':
+				depth++
+				if depth == 2 {
+					row = nil
+					is_key = true
+				}
+			case ']', '}':
+				if depth == 2 {
+					rows = append(rows, row)
+				}
+				depth--
+			}
+			continue
+		case json.Number:
+			if i, err := value.Int64(); err == nil {
+				token = i
+			} else if f, err := value.Float64(); err == nil {
+				token = f
+			}
+		}
+
+		if depth != 2 {
+			continue
+		}
+
+		if !is_key {
+			row = append(row, token)
+		}
+		is_key = !is_key
+	}
+}
+
+func (d *execDatabase) IntegrityCheck() error {
+	var out bytes.Buffer
+	if err := d.run(nil, &out, "PRAGMA integrity_check;"); err != nil {
+		return err
+	}
+
+	result := strings.TrimSpace(out.String())
+	if result != "ok" {
+		return fmt.Errorf("integrity check failed: %s", result)
+	}
+
+	return nil
+}
+
+func (d *execDatabase) Close() error {
+	return nil
+}
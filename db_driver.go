@@ -0,0 +1,307 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+const haveDriver = true
+
+type driverDatabase struct {
+	path string
+	db   *sql.DB
+}
+
+// driverDSN is a file: URI for path, so it can have any characters in it
+func driverDSN(path string) string {
+	return "file:" + (&url.URL{Path: path}).EscapedPath() + "?_busy_timeout=5000"
+}
+
+func openDriverDatabase(path string) (Database, error) {
+	db, err := sql.Open("sqlite3", driverDSN(path))
+	if err != nil {
+		return nil, err
+	}
+
+	// PRAGMAs and transactions in dumps need to stay on one connection
+	db.SetMaxOpenConns(1)
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &driverDatabase{path: path, db: db}, nil
+}
+
+func (d *driverDatabase) Close() error {
+	return d.db.Close()
+}
+
+func (d *driverDatabase) Dump(w io.Writer) error {
+	// everything is read in one transaction for a consistent dump
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	out := bufio.NewWriter(w)
+
+	out.WriteString("PRAGMA foreign_keys=OFF;\nBEGIN TRANSACTION;\n")
+
+	rows, err := tx.Query("SELECT name, sql FROM sqlite_master WHERE sql NOT NULL AND type = 'table' ORDER BY tbl_name = 'sqlite_sequence', rowid")
+	if err != nil {
+		return err
+	}
+
+	type table struct{ name, sql string }
+	var tables []table
+	for rows.Next() {
+		var t table
+		if err := rows.Scan(&t.name, &t.sql); err != nil {
+			rows.Close()
+			return err
+		}
+		tables = append(tables, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	writable_schema := false
+	for _, t := range tables {
+		switch {
+		case t.name == "sqlite_sequence":
+			out.WriteString("DELETE FROM sqlite_sequence;\n")
+		case t.name == "sqlite_stat1":
+			out.WriteString("ANALYZE sqlite_master;\n")
+		case strings.HasPrefix(t.name, "sqlite_"):
+			continue
+		case strings.HasPrefix(strings.ToUpper(t.sql), "CREATE VIRTUAL TABLE"):
+			// virtual tables are restored through the schema so that their
+			// shadow tables can be filled in directly, like the sqlite3 shell does
+			if !writable_schema {
+				out.WriteString("PRAGMA writable_schema=ON;\n")
+				writable_schema = true
+			}
+			fmt.Fprintf(out, "INSERT INTO sqlite_master(type,name,tbl_name,rootpage,sql) VALUES('table',%s,%s,0,%s);\n", quoteLiteral(t.name), quoteLiteral(t.name), quoteLiteral(t.sql))
+			continue
+		default:
+			fmt.Fprintf(out, "%s;\n", t.sql)
+		}
+
+		if err := dumpRows(tx, out, t.name); err != nil {
+			return err
+		}
+	}
+
+	if writable_schema {
+		out.WriteString("PRAGMA writable_schema=OFF;\n")
+	}
+
+	rows, err = tx.Query("SELECT sql FROM sqlite_master WHERE sql NOT NULL AND type IN ('index', 'trigger', 'view') ORDER BY rowid")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var schema_sql string
+		if err := rows.Scan(&schema_sql); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s;\n", schema_sql)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	out.WriteString("COMMIT;\n")
+
+	return out.Flush()
+}
+
+func dumpRows(tx *sql.Tx, out *bufio.Writer, table string) error {
+	rows, err := tx.Query(fmt.Sprintf("SELECT * FROM %s LIMIT 0", quoteIdentifier(table)))
+	if err != nil {
+		return err
+	}
+	columns, err := rows.Columns()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	// quote() renders each value as a SQL literal, which sidesteps the
+	// driver's type conversions (e.g. DATETIME columns into time.Time)
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = fmt.Sprintf("quote(%s)", quoteIdentifier(column))
+	}
+
+	rows, err = tx.Query(fmt.Sprintf("SELECT %s FROM %s", strings.Join(quoted, "||','||"), quoteIdentifier(table)))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	insert := fmt.Sprintf("INSERT INTO %s VALUES(", quoteIdentifier(table))
+	for rows.Next() {
+		var values string
+		if err := rows.Scan(&values); err != nil {
+			return err
+		}
+
+		out.WriteString(insert)
+		out.WriteString(values)
+		out.WriteString(");\n")
+	}
+
+	return rows.Err()
+}
+
+func (d *driverDatabase) Restore(r io.Reader) error {
+	ctx := context.Background()
+
+	conn, err := d.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	script := newSQLScanner(r)
+	for script.Scan() {
+		if _, err := conn.ExecContext(ctx, script.Statement()); err != nil {
+			conn.ExecContext(ctx, "ROLLBACK")
+			return fmt.Errorf("%s, in statement: %.200s", err, script.Statement())
+		}
+	}
+
+	return script.Err()
+}
+
+func (d *driverDatabase) Exec(script string) error {
+	return d.Restore(strings.NewReader(script))
+}
+
+func (d *driverDatabase) Query(query string) ([][]interface{}, error) {
+	rows, err := d.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	var results [][]interface{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		results = append(results, values)
+	}
+
+	return results, rows.Err()
+}
+
+func (d *driverDatabase) Backup(dest string) error {
+	ctx := context.Background()
+
+	dest_db, err := sql.Open("sqlite3", driverDSN(dest))
+	if err != nil {
+		return err
+	}
+	defer dest_db.Close()
+
+	dest_conn, err := dest_db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dest_conn.Close()
+
+	src_conn, err := d.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer src_conn.Close()
+
+	return dest_conn.Raw(func(dest_raw interface{}) error {
+		return src_conn.Raw(func(src_raw interface{}) error {
+			backup, err := dest_raw.(*sqlite3.SQLiteConn).Backup("main", src_raw.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+
+			deadline := time.Now().Add(30 * time.Second)
+			for {
+				done, err := backup.Step(-1)
+				if err != nil {
+					backup.Finish()
+					return err
+				}
+				if done {
+					break
+				}
+
+				// the source is locked by a writer, give it a moment
+				if time.Now().After(deadline) {
+					backup.Finish()
+					return fmt.Errorf("timed out waiting for database lock")
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+
+			return backup.Finish()
+		})
+	})
+}
+
+func (d *driverDatabase) IntegrityCheck() error {
+	rows, err := d.db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return err
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("integrity check failed: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !cgo
+// +build !cgo
+
+package main
+
+import "errors"
+
+const haveDriver = false
+
+func openDriverDatabase(path string) (Database, error) {
+	return nil, errors.New("watchdb was built without the sqlite driver, use --sqlite-binary")
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// paths that would be taken apart if they went into a DSN or a dot-command
+// as is
+var oddNames = []string{"what?.db", "number#1.db", "it's.db", `say "hi".db`, `back\slash.db`, "50%.db"}
+
+func testBackups(t *testing.T, open func(path string) Database) {
+	dir := t.TempDir()
+
+	for _, name := range oddNames {
+		path := filepath.Join(dir, name)
+
+		db := open(path)
+		if err := db.Exec("CREATE TABLE t(x); INSERT INTO t VALUES(" + quoteLiteral(name) + ");"); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		if dbexists, _ := exists(path); !dbexists {
+			t.Fatalf("%s wasn't created at its path", name)
+		}
+
+		backup_path := filepath.Join(dir, "backup of "+name)
+		if err := db.Backup(backup_path); err != nil {
+			t.Fatalf("unable to back up %s: %s", name, err)
+		}
+		db.Close()
+
+		backup := open(backup_path)
+		defer backup.Close()
+
+		if values := queryValues(t, backup, "SELECT x FROM t"); len(values) != 1 || values[0] != name {
+			t.Errorf("backup of %s has %v", name, values)
+		}
+	}
+}
+
+func TestDriverPaths(t *testing.T) {
+	if !haveDriver {
+		t.Skip("built without the sqlite driver")
+	}
+
+	testBackups(t, func(path string) Database {
+		db, err := openDriverDatabase(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	})
+}
+
+func TestExecPaths(t *testing.T) {
+	binary, err := exec.LookPath("sqlite3")
+	if err != nil {
+		t.Skip("no sqlite3 binary")
+	}
+
+	testBackups(t, func(path string) Database {
+		return &execDatabase{path: path, binary: binary}
+	})
+}
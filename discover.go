@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/howeyc/fsnotify"
+)
+
+// discovery serves every sqlite DB under a directory, named by its path
+// relative to the directory. New DBs are picked up as they appear (by their
+// header, whatever they're called) and deleted ones stop being served.
+type discovery struct {
+	root    string
+	options WatchConfig
+
+	mu     sync.Mutex
+	failed map[string]bool
+}
+
+func newDiscovery(root string, options WatchConfig) *discovery {
+	return &discovery{
+		root:    filepath.Clean(root),
+		options: options,
+		failed:  make(map[string]bool),
+	}
+}
+
+func isSqliteFile(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	header := make([]byte, len(sqliteHeader))
+	if _, err := io.ReadFull(file, header); err != nil {
+		return false
+	}
+
+	return bytes.Equal(header, sqliteHeader)
+}
+
+// ignored is for files that are never DBs worth serving, even though some of
+// them start with a sqlite header
+func (d *discovery) ignored(path string) bool {
+	base := filepath.Base(path)
+
+	for _, suffix := range []string{"-wal", "-shm", "-journal", ".watchdb-import"} {
+		if strings.HasSuffix(base, suffix) {
+			return true
+		}
+	}
+
+	// backups left by a syncer, when replicas are themselves being watched
+	for _, suffix := range []string{".old", ".orig"} {
+		if strings.HasSuffix(path, suffix) {
+			if original_exists, _ := exists(strings.TrimSuffix(path, suffix)); original_exists {
+				return true
+			}
+		}
+	}
+
+	if dir := filepath.Dir(path); strings.HasSuffix(dir, ".backups") && backupName.MatchString(base) {
+		return true
+	}
+
+	return false
+}
+
+// scan watches dir and everything below it, serving any DBs found
+func (d *discovery) scan(dir string) {
+	// a directory containing our own snapshots would find them forever
+	watchdb_dir := filepath.Clean(createWatchDBDir())
+
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			log.Warning("unable to read %s: %s", path, err)
+			return nil
+		}
+
+		if info.IsDir() {
+			if filepath.Clean(path) == watchdb_dir {
+				return filepath.SkipDir
+			}
+
+			if err := databases.watcher.addDir(path, d.handleEvent); err != nil {
+				log.Warning("unable to watch directory %s: %s", path, err)
+			}
+			return nil
+		}
+
+		if info.Mode().IsRegular() {
+			d.consider(path)
+		}
+
+		return nil
+	})
+}
+
+// consider starts serving path if it's a sqlite DB that isn't already served
+func (d *discovery) consider(path string) {
+	path = filepath.Clean(path)
+
+	if d.ignored(path) || databases.byPath(path) != nil || databases.isStarting(path) || !isSqliteFile(path) {
+		return
+	}
+
+	rel, err := filepath.Rel(d.root, path)
+	if err != nil {
+		return
+	}
+
+	db := newWatchedDB(filepath.ToSlash(rel), path)
+	db.discovered = true
+
+	err = databases.add(db, d.options)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err != nil {
+		// likely still being written, it'll be tried again when it changes
+		if !d.failed[path] {
+			log.Warning("found %s, but unable to serve it yet: %s", path, err)
+		}
+		d.failed[path] = true
+		return
+	}
+
+	delete(d.failed, path)
+}
+
+// forget stops watching dir (which was deleted or moved away) along with
+// every DB inside it
+func (d *discovery) forget(dir string) {
+	for _, watched := range databases.watcher.watchedDirs(dir) {
+		databases.watcher.removeDir(watched)
+	}
+
+	databases.removeUnder(dir)
+}
+
+func (d *discovery) handleEvent(ev *fsnotify.FileEvent) {
+	path := filepath.Clean(ev.Name)
+
+	if ev.IsDelete() || ev.IsRename() {
+		d.forget(path)
+
+		d.mu.Lock()
+		delete(d.failed, path)
+		d.mu.Unlock()
+		return
+	}
+
+	if !ev.IsCreate() && !ev.IsModify() {
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+
+	if info.IsDir() {
+		if ev.IsCreate() {
+			d.scan(path)
+		}
+		return
+	}
+
+	if info.Mode().IsRegular() {
+		d.consider(path)
+	}
+}
+
+// how often a syncer mirroring a directory checks upstream for new DBs
+const discoveryInterval = 5 * time.Second
+
+func fetchDatabases(client *http.Client, addr string, options WatchConfig) ([]databaseInfo, error) {
+	req, err := http.NewRequest("GET", databaseURL(addr, "", options)+"/dbs", nil)
+	if err != nil {
+		return nil, err
+	}
+	if options.AuthKey != "" {
+		req.Header.Add("Authorization", options.AuthKey)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 401 {
+		return nil, errUnauthorized
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("upstream returned %s", resp.Status)
+	}
+
+	var list []databaseInfo
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// syncDirectory mirrors every DB served upstream into dir, laid out by name.
+// DBs that stop being served upstream stop being synced, but their local
+// copies are left in place.
+func syncDirectory(addr string, dir string, options WatchConfig) {
+	client := syncClient(options)
+	syncing := make(map[string]chan bool)
+
+	for {
+		list, err := fetchDatabases(client, addr, options)
+
+		if err == errUnauthorized {
+			log.Error("upstream rejected the authentication key, unable to list databases")
+			return
+		}
+
+		if err != nil {
+			log.Warning("unable to list upstream databases, retrying in %s: %s", discoveryInterval, err)
+			time.Sleep(discoveryInterval)
+			continue
+		}
+
+		served := make(map[string]bool)
+		for _, info := range list {
+			served[info.Name] = true
+
+			if _, ok := syncing[info.Name]; ok {
+				continue
+			}
+
+			if !validDatabaseName(info.Name) {
+				log.Warning("skipping upstream database with unusable name '%s'", info.Name)
+				continue
+			}
+
+			path := filepath.Join(dir, filepath.FromSlash(info.Name))
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				log.Warning("unable to create directory for %s: %s", path, err)
+				continue
+			}
+
+			log.Notice("found upstream database %s, syncing to %s", info.Name, path)
+
+			stop := make(chan bool)
+			syncing[info.Name] = stop
+			go syncDB(addr, DatabaseConfig{Name: info.Name, Path: path}, options, stop)
+		}
+
+		for name, stop := range syncing {
+			if !served[name] {
+				log.Notice("upstream database %s is no longer served, leaving the local copy in place", name)
+				close(stop)
+				delete(syncing, name)
+			}
+		}
+
+		time.Sleep(discoveryInterval)
+	}
+}
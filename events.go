@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// how often idle event streams get a heartbeat; syncers treat a stream that's
+// been silent for a few of these as dead and reconnect
+var heartbeatInterval = 15 * time.Second
+
+var errEventsUnsupported = errors.New("upstream doesn't support event streams")
+var errUpstreamShutdown = errors.New("upstream is shutting down")
+var errUnauthorized = syncFailure("unauthorized", "upstream rejected authentication")
+
+// closed when the watcher is shutting down, so connected syncers can be told
+var shutting_down = make(chan bool)
+
+// handleShutdown tells connected syncers that the watcher is going away
+// before exiting on SIGINT/SIGTERM
+func handleShutdown() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-signals
+
+		log.Notice("shutting down, notifying connected clients (%d)", databases.subscriberCount())
+		close(shutting_down)
+
+		// give handlers a moment to get the notice out
+		time.Sleep(500 * time.Millisecond)
+		os.Exit(0)
+	}()
+}
+
+// hub keeps track of connected syncers so they can be told about changes.
+// Each subscriber gets a channel with room for one pending message; a
+// subscriber that already has one queued doesn't need another, since change
+// messages are always answered with the latest snapshot.
+type hub struct {
+	mu          sync.Mutex
+	subscribers map[chan string]bool
+}
+
+func newHub() *hub {
+	return &hub{subscribers: make(map[chan string]bool)}
+}
+
+func (h *hub) subscribe() chan string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	message := make(chan string, 1)
+	h.subscribers[message] = true
+
+	return message
+}
+
+func (h *hub) unsubscribe(message chan string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.subscribers, message)
+}
+
+// broadcast returns how many subscribers were sent the message
+func (h *hub) broadcast(message string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sent := 0
+	for subscriber := range h.subscribers {
+		select {
+		case subscriber <- message:
+			sent++
+		default:
+			// already has a message waiting
+		}
+	}
+
+	return sent
+}
+
+func (h *hub) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.subscribers)
+}
+
+type changeEvent struct {
+	Version uint64 `json:"version"`
+	Hash    string `json:"hash"`
+}
+
+func writeEvent(w io.Writer, id uint64, event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	if id > 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", id); err != nil {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+	return err
+}
+
+// serveEvents streams change events to a syncer over one long-lived
+// connection (Server-Sent Events). A syncer reconnecting with Last-Event-ID
+// (or since=<version>) is sent the current version right away if it missed
+// anything in between.
+func serveEvents(w http.ResponseWriter, r *http.Request, db *watchedDB) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", 500)
+		return
+	}
+
+	var last_sent uint64
+	last_id := r.Header.Get("Last-Event-ID")
+	if last_id == "" {
+		last_id = r.URL.Query().Get("since")
+	}
+	if last_id != "" {
+		last_sent, _ = strconv.ParseUint(last_id, 10, 64)
+	}
+
+	message := db.subscribers.subscribe()
+	defer db.subscribers.unsubscribe(message)
+
+	log.Debug("remote syncer %s connected to event stream for %s", r.RemoteAddr, db.name)
+	defer log.Debug("remote syncer %s disconnected from event stream for %s", r.RemoteAddr, db.name)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	fmt.Fprintf(w, "retry: 5000\n\n")
+
+	send_change := func() error {
+		current := db.acquireSnapshot()
+		if current == nil {
+			return nil
+		}
+		defer current.release()
+
+		if current.version <= last_sent {
+			return nil
+		}
+
+		last_sent = current.version
+		return writeEvent(w, current.version, "change", changeEvent{Version: current.version, Hash: current.Hash()})
+	}
+
+	if err := send_change(); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	notify := w.(http.CloseNotifier).CloseNotify()
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		var err error
+
+		select {
+		case <-notify:
+			return
+		case <-message:
+			err = send_change()
+		case <-heartbeat.C:
+			err = writeEvent(w, 0, "heartbeat", changeEvent{Version: last_sent})
+		case <-db.stopped:
+			return
+		case <-shutting_down:
+			writeEvent(w, 0, "shutdown", map[string]string{"message": "server shutting down"})
+			flusher.Flush()
+			return
+		}
+
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// followEvents reads the upstream event stream until it ends, queueing a
+// download for every change newer than known_version
+func followEvents(client *http.Client, events_url string, options WatchConfig, status *replicaStatus, known_version *uint64, download chan bool) error {
+	req, err := http.NewRequest("GET", events_url, nil)
+	if err != nil {
+		return err
+	}
+	if options.AuthKey != "" {
+		req.Header.Add("Authorization", options.AuthKey)
+	}
+	req.Header.Add("Accept", "text/event-stream")
+	if *known_version > 0 {
+		req.Header.Add("Last-Event-ID", strconv.FormatUint(*known_version, 10))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 200:
+	case 401:
+		return errUnauthorized
+	case 404:
+		return errEventsUnsupported
+	default:
+		return fmt.Errorf("upstream returned %s", resp.Status)
+	}
+
+	// a stream that's gone quiet for too long is likely dead without us
+	// having been told, so drop it and reconnect
+	timeout := time.AfterFunc(3*heartbeatInterval, func() {
+		resp.Body.Close()
+	})
+	defer timeout.Stop()
+
+	var event string
+	var data string
+
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				return errors.New("upstream closed the event stream")
+			}
+			return err
+		}
+
+		timeout.Reset(3 * heartbeatInterval)
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		case line == "":
+			switch event {
+			case "change":
+				change := changeEvent{}
+				if err := json.Unmarshal([]byte(data), &change); err != nil {
+					log.Warning("unknown change event received from upstream: %s", data)
+					break
+				}
+
+				status.announced(change.Version)
+
+				if change.Version > *known_version {
+					log.Debug("upstream DB changed, now at version %d", change.Version)
+					*known_version = change.Version
+					queueDownload(download)
+				}
+			case "shutdown":
+				return errUpstreamShutdown
+			}
+
+			event = ""
+			data = ""
+		}
+	}
+}
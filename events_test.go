@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newEventsServer(t *testing.T) (*watchedDB, Database, string) {
+	db, source := watchTestDB(t, "CREATE TABLE t(x);")
+	if _, err := db.refreshSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveEvents(w, r, db)
+	}))
+	t.Cleanup(server.Close)
+
+	return db, source, server.URL + "/events"
+}
+
+// changeAndNotify writes to the watched DB, takes a new snapshot and tells
+// subscribers about it, the way the watcher does
+func changeAndNotify(t *testing.T, db *watchedDB, source Database) uint64 {
+	if err := source.Exec("INSERT INTO t VALUES(1);"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.refreshSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	db.subscribers.broadcast("change")
+
+	current := db.acquireSnapshot()
+	defer current.release()
+
+	return current.version
+}
+
+// openEvents connects to the event stream and reads up to the retry
+// interval, which is sent once the stream is subscribed to changes
+func openEvents(t *testing.T, events_url string, last_id string) (*bufio.Reader, func()) {
+	req, err := http.NewRequest("GET", events_url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last_id != "" {
+		req.Header.Add("Last-Event-ID", last_id)
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	if line, err := reader.ReadString('\n'); err != nil || line != "retry: 5000\n" {
+		t.Fatalf("event stream started with %q (%v)", line, err)
+	}
+	reader.ReadString('\n')
+
+	return reader, func() { resp.Body.Close() }
+}
+
+// readEvent returns the id and name of the next event on the stream
+func readEvent(t *testing.T, reader *bufio.Reader) (uint64, string) {
+	var id uint64
+	var event string
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("event stream ended: %s", err)
+		}
+		line = strings.TrimRight(line, "\n")
+
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id, _ = strconv.ParseUint(strings.TrimPrefix(line, "id: "), 10, 64)
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case line == "":
+			return id, event
+		}
+	}
+}
+
+func TestEventsResume(t *testing.T) {
+	db, source, events_url := newEventsServer(t)
+	missed := changeAndNotify(t, db, source)
+
+	// a syncer that missed a change hears about it as soon as it's back
+	for _, last_id := range []string{"", fmt.Sprint(missed - 1)} {
+		reader, close := openEvents(t, events_url, last_id)
+		if id, event := readEvent(t, reader); event != "change" || id != missed {
+			t.Errorf("reconnecting with Last-Event-ID %q got %s %d, expected change %d", last_id, event, id, missed)
+		}
+		close()
+	}
+
+	// one that's current only hears about the next change
+	reader, close := openEvents(t, events_url, fmt.Sprint(missed))
+	defer close()
+
+	next := changeAndNotify(t, db, source)
+	if id, event := readEvent(t, reader); event != "change" || id != next {
+		t.Errorf("current syncer got %s %d, expected change %d", event, id, next)
+	}
+}
+
+func TestFollowEvents(t *testing.T) {
+	heartbeat := heartbeatInterval
+	heartbeatInterval = 20 * time.Millisecond
+	defer func() {
+		heartbeatInterval = heartbeat
+	}()
+
+	db, source, events_url := newEventsServer(t)
+	status := replicas.add("app", filepath.Join(t.TempDir(), "replica.db"))
+	defer replicas.remove(status.path)
+
+	current := db.acquireSnapshot()
+	known_version := current.version - 1
+	current.release()
+
+	download := make(chan bool, 1)
+	done := make(chan error)
+	go func() {
+		done <- followEvents(http.DefaultClient, events_url, WatchConfig{}, status, &known_version, download)
+	}()
+
+	select {
+	case <-download:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no download queued for a version the syncer missed")
+	}
+
+	// heartbeats keep a stream with no changes on it open
+	time.Sleep(10 * heartbeatInterval)
+
+	next := changeAndNotify(t, db, source)
+	select {
+	case <-download:
+		if known_version != next {
+			t.Errorf("syncer knows of version %d, expected %d", known_version, next)
+		}
+	case err := <-done:
+		t.Fatalf("stream with heartbeats on it was dropped: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no download queued for a change")
+	}
+
+	close(db.stopped)
+	if err := <-done; err == nil {
+		t.Error("followEvents returned without an error when the stream ended")
+	}
+}
+
+func TestFollowEventsTimeout(t *testing.T) {
+	heartbeat := heartbeatInterval
+	heartbeatInterval = 20 * time.Millisecond
+	defer func() {
+		heartbeatInterval = heartbeat
+	}()
+
+	// upstream that stops sending anything, heartbeats included
+	stop := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "retry: 5000\n\n")
+		w.(http.Flusher).Flush()
+
+		select {
+		case <-r.Context().Done():
+		case <-stop:
+		}
+	}))
+	defer server.Close()
+	defer close(stop)
+
+	status := replicas.add("app", filepath.Join(t.TempDir(), "replica.db"))
+	defer replicas.remove(status.path)
+
+	var known_version uint64
+	done := make(chan error)
+	go func() {
+		done <- followEvents(http.DefaultClient, server.URL+"/events", WatchConfig{}, status, &known_version, make(chan bool, 1))
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("silent stream was dropped without an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("silent stream wasn't dropped")
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ReplicationFilter limits what's sent to syncers to some of a DB's tables,
+// and optionally to some of their rows. Tables left out of Include (when it's
+// given) or named in Exclude never leave the watcher, and Where holds SQL
+// predicates rows of a table must match to be sent.
+type ReplicationFilter struct {
+	Include []string          `yaml:"include,omitempty"`
+	Exclude []string          `yaml:"exclude,omitempty"`
+	Where   map[string]string `yaml:"where,omitempty"`
+}
+
+// replicaView is what a client gets to see of a DB: the filters a table or
+// row has to get through to be sent, and the redaction profiles applied to
+// what's left
+type replicaView struct {
+	Filters  []ReplicationFilter
+	Profiles []RedactionProfile
+
+	// names of the redaction profiles, which syncers record
+	Redaction string
+}
+
+func (v replicaView) empty() bool {
+	return len(v.Filters) == 0 && len(v.Profiles) == 0
+}
+
+// id identifies the view, for sharing snapshots between clients that see the
+// same thing
+func (v replicaView) id() string {
+	data, _ := json.Marshal(v)
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hasTable(tables []string, name string) bool {
+	for _, table := range tables {
+		if strings.EqualFold(table, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f ReplicationFilter) allows(table string) bool {
+	if len(f.Include) > 0 && !hasTable(f.Include, table) {
+		return false
+	}
+
+	return !hasTable(f.Exclude, table)
+}
+
+func (f ReplicationFilter) predicate(table string) string {
+	for name, predicate := range f.Where {
+		if strings.EqualFold(name, table) {
+			return predicate
+		}
+	}
+
+	return ""
+}
+
+// filterScript strips a copy of a DB with the given tables down to what the
+// view's filters let through. The change feed goes too (even with no
+// filters), since it records changes to every table, row and column.
+func (v replicaView) filterScript(tables []string, triggers map[string]string) string {
+	var script strings.Builder
+	script.WriteString("BEGIN;\n")
+
+	trigger_names := make([]string, 0, len(triggers))
+	for name := range triggers {
+		trigger_names = append(trigger_names, name)
+	}
+	sort.Strings(trigger_names)
+
+	for _, name := range trigger_names {
+		fmt.Fprintf(&script, "DROP TRIGGER %s;\n", quoteIdentifier(name))
+	}
+	fmt.Fprintf(&script, "DROP TABLE IF EXISTS %s;\n", quoteIdentifier(changesTable))
+
+	for _, table := range tables {
+		allowed := true
+		var predicates []string
+
+		for _, filter := range v.Filters {
+			if !filter.allows(table) {
+				allowed = false
+				break
+			}
+
+			if predicate := filter.predicate(table); predicate != "" {
+				predicates = append(predicates, "("+predicate+")")
+			}
+		}
+
+		switch {
+		case !allowed:
+			fmt.Fprintf(&script, "DROP TABLE %s;\n", quoteIdentifier(table))
+		case len(predicates) > 0:
+			// a predicate that comes out NULL doesn't match either
+			fmt.Fprintf(&script, "DELETE FROM %s WHERE NOT coalesce(%s, 0);\n", quoteIdentifier(table), strings.Join(predicates, " AND "))
+		}
+	}
+
+	script.WriteString("COMMIT;\n")
+
+	return script.String()
+}
+
+// viewSnapshot is built the first time a client with its view asks for it,
+// and shared by every client with the same view after that
+type viewSnapshot struct {
+	once     sync.Once
+	snapshot *snapshot
+	err      error
+}
+
+// acquireView returns the current snapshot as seen through view, which is
+// released like any other snapshot. Snapshots with the change feed in them
+// always go through a view, even an empty one, which takes the feed out: its
+// triggers would fire on replicas too.
+func (db *watchedDB) acquireView(view replicaView) (*snapshot, error) {
+	base := db.acquireSnapshot()
+	if base == nil || (view.empty() && !base.feed) {
+		return base, nil
+	}
+
+	id := view.id()
+
+	db.snapshot_lock.Lock()
+	if base.views == nil {
+		base.views = make(map[string]*viewSnapshot)
+	}
+	built, ok := base.views[id]
+	if !ok {
+		built = &viewSnapshot{}
+		base.views[id] = built
+	}
+	db.snapshot_lock.Unlock()
+
+	built.once.Do(func() {
+		snapshot_path := strings.TrimSuffix(base.path, ".db") + "-" + id[:12] + ".db"
+		built.snapshot, built.err = buildViewSnapshot(base, view, snapshot_path)
+	})
+
+	if built.err != nil {
+		base.release()
+		return nil, built.err
+	}
+
+	return built.snapshot, nil
+}
+
+// buildViewSnapshot copies base to snapshot_path and applies the view to the
+// copy, which gets the same version as base
+func buildViewSnapshot(base *snapshot, view replicaView, snapshot_path string) (*snapshot, error) {
+	_ = os.Remove(snapshot_path)
+
+	if err := copyFileContents(base.path, snapshot_path); err != nil {
+		_ = os.Remove(snapshot_path)
+		return nil, err
+	}
+
+	if err := applyView(snapshot_path, view); err != nil {
+		_ = os.Remove(snapshot_path)
+		return nil, err
+	}
+
+	page_size, err := readPageSize(snapshot_path)
+	if err != nil {
+		_ = os.Remove(snapshot_path)
+		return nil, err
+	}
+
+	manifest, err := buildPageManifest(snapshot_path, page_size)
+	if err != nil {
+		_ = os.Remove(snapshot_path)
+		return nil, err
+	}
+	manifest.Version = base.version
+	manifest.Redaction = view.Redaction
+
+	return &snapshot{db: base.db, path: snapshot_path, version: base.version, manifest: manifest, parent: base}, nil
+}
+
+func applyView(path string, view replicaView) error {
+	source, err := openDatabase(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	rows, err := source.Query(`SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite\_%' ESCAPE '\' AND name NOT LIKE '\_watchdb\_%' ESCAPE '\'`)
+	if err != nil {
+		return err
+	}
+
+	var tables []string
+	for _, row := range rows {
+		tables = append(tables, asString(row[0]))
+	}
+
+	triggers, err := installedTriggers(source)
+	if err != nil {
+		return err
+	}
+
+	// the DB's own triggers would otherwise fire on the rows filters delete
+	// and the values profiles redact, and could copy them somewhere else (an
+	// audit table, say) or delete more than the filter asked for
+	saved, err := applicationTriggers(source)
+	if err != nil {
+		return err
+	}
+
+	var drop strings.Builder
+	for _, trigger := range saved {
+		fmt.Fprintf(&drop, "DROP TRIGGER %s;\n", quoteIdentifier(trigger.name))
+	}
+	if err := source.Exec(drop.String()); err != nil {
+		return fmt.Errorf("unable to set aside triggers: %s", err)
+	}
+
+	if err := source.Exec(view.filterScript(tables, triggers)); err != nil {
+		return fmt.Errorf("unable to apply replication filter: %s", err)
+	}
+
+	for _, profile := range view.Profiles {
+		if err := profile.apply(source); err != nil {
+			return fmt.Errorf("unable to apply redaction profile: %s", err)
+		}
+	}
+
+	if err := restoreTriggers(source, saved); err != nil {
+		return fmt.Errorf("unable to restore triggers: %s", err)
+	}
+
+	// dropped tables, deleted rows and redacted values would otherwise
+	// linger in free pages
+	return source.Exec("VACUUM;\n")
+}
+
+// savedTrigger is one of the DB's own triggers, as it was created
+type savedTrigger struct {
+	name  string
+	table string
+	sql   string
+}
+
+func applicationTriggers(source Database) ([]savedTrigger, error) {
+	rows, err := source.Query(`SELECT name, tbl_name, sql FROM sqlite_master WHERE type = 'trigger' AND name NOT LIKE '\_watchdb\_%' ESCAPE '\' ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+
+	var triggers []savedTrigger
+	for _, row := range rows {
+		triggers = append(triggers, savedTrigger{name: asString(row[0]), table: asString(row[1]), sql: asString(row[2])})
+	}
+
+	return triggers, nil
+}
+
+// restoreTriggers recreates triggers set aside while a view was applied,
+// except those of tables the view dropped
+func restoreTriggers(source Database, triggers []savedTrigger) error {
+	rows, err := source.Query(`SELECT name FROM sqlite_master WHERE type IN ('table', 'view')`)
+	if err != nil {
+		return err
+	}
+
+	var remaining []string
+	for _, row := range rows {
+		remaining = append(remaining, asString(row[0]))
+	}
+
+	var script strings.Builder
+	for _, trigger := range triggers {
+		if hasTable(remaining, trigger.table) {
+			fmt.Fprintf(&script, "%s;\n", trigger.sql)
+		}
+	}
+
+	return source.Exec(script.String())
+}
+
+// viewFor returns what a client of db gets to see: the DB's own filter and
+// redaction profile (or the default ones), along with the ones of the client's
+// identity
+func (db *watchedDB) viewFor(client *Identity, options WatchConfig) replicaView {
+	var view replicaView
+
+	filter := db.filter
+	if filter == "" {
+		filter = options.Filter
+	}
+	if filter != "" {
+		view.Filters = append(view.Filters, options.Filters[filter])
+	}
+
+	redaction := db.redaction
+	if redaction == "" {
+		redaction = options.Redaction
+	}
+
+	var profiles []string
+	if redaction != "" {
+		profiles = append(profiles, redaction)
+	}
+
+	if client != nil {
+		if client.Filter != "" {
+			view.Filters = append(view.Filters, options.Filters[client.Filter])
+		}
+		if client.Redaction != "" && client.Redaction != redaction {
+			profiles = append(profiles, client.Redaction)
+		}
+	}
+
+	for _, name := range profiles {
+		view.Profiles = append(view.Profiles, options.Redactions[name])
+	}
+	view.Redaction = strings.Join(profiles, "+")
+
+	return view
+}
+
+// checkViews makes sure every filter and redaction profile that's referred to
+// exists
+func checkViews(options WatchConfig) error {
+	check := func(name string, user string, redaction bool) error {
+		if name == "" {
+			return nil
+		}
+
+		if redaction {
+			if _, ok := options.Redactions[name]; !ok {
+				return fmt.Errorf("redaction profile '%s' used by %s isn't defined under redactions", name, user)
+			}
+		} else if _, ok := options.Filters[name]; !ok {
+			return fmt.Errorf("filter '%s' used by %s isn't defined under filters", name, user)
+		}
+
+		return nil
+	}
+
+	if err := check(options.Filter, "the filter setting", false); err != nil {
+		return err
+	}
+	if err := check(options.Redaction, "the redaction setting", true); err != nil {
+		return err
+	}
+
+	for _, database := range options.Databases {
+		if err := check(database.Filter, database.Path, false); err != nil {
+			return err
+		}
+		if err := check(database.Redaction, database.Path, true); err != nil {
+			return err
+		}
+	}
+
+	if err := checkIdentities(options.Keyring); err != nil {
+		return err
+	}
+
+	for _, id := range options.Keyring {
+		user := "identity " + id.Name
+
+		if err := check(id.Filter, user, false); err != nil {
+			return err
+		}
+		if err := check(id.Redaction, user, true); err != nil {
+			return err
+		}
+	}
+
+	for name, profile := range options.Redactions {
+		if err := profile.check(); err != nil {
+			return fmt.Errorf("redaction profile '%s': %s", name, err)
+		}
+	}
+
+	return nil
+}
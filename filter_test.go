@@ -0,0 +1,128 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func createTestDB(t *testing.T, script string) (string, Database) {
+	if !haveDriver {
+		t.Skip("built without the sqlite driver")
+	}
+
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	db, err := openDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := db.Exec(script); err != nil {
+		t.Fatal(err)
+	}
+
+	return path, db
+}
+
+// watchTestDB watches a new DB created with script, keeping what the watcher
+// stores under a temporary HOME
+func watchTestDB(t *testing.T, script string) (*watchedDB, Database) {
+	t.Setenv("HOME", t.TempDir())
+
+	path, source := createTestDB(t, script)
+
+	db := newWatchedDB("app", path)
+	t.Cleanup(db.dropSnapshot)
+
+	return db, source
+}
+
+func queryValues(t *testing.T, db Database, query string) []string {
+	rows, err := db.Query(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var values []string
+	for _, row := range rows {
+		values = append(values, asString(row[0]))
+	}
+
+	return values
+}
+
+const auditedSchema = `
+CREATE TABLE users(id INTEGER PRIMARY KEY, email TEXT);
+CREATE TABLE orders(id INTEGER PRIMARY KEY, user_id INTEGER);
+CREATE TABLE audit(old_email TEXT);
+CREATE TRIGGER audit_email AFTER UPDATE OF email ON users BEGIN
+  INSERT INTO audit VALUES(OLD.email);
+END;
+CREATE TRIGGER delete_orders AFTER DELETE ON users BEGIN
+  DELETE FROM orders WHERE user_id = OLD.id;
+END;
+INSERT INTO users VALUES(1, 'alice@example.com'), (2, 'bob@example.com');
+INSERT INTO orders VALUES(10, 1), (20, 2);
+`
+
+func TestRedactionDoesNotFireTriggers(t *testing.T) {
+	path, db := createTestDB(t, auditedSchema)
+
+	view := replicaView{Profiles: []RedactionProfile{{
+		Columns: []RedactionRule{{Table: "users", Column: "email", Action: "fixed", Value: "redacted"}},
+	}}}
+
+	if err := applyView(path, view); err != nil {
+		t.Fatal(err)
+	}
+
+	if audited := queryValues(t, db, "SELECT old_email FROM audit"); len(audited) > 0 {
+		t.Errorf("trigger copied redacted values into the audit table: %v", audited)
+	}
+
+	if emails := queryValues(t, db, "SELECT DISTINCT email FROM users"); len(emails) != 1 || emails[0] != "redacted" {
+		t.Errorf("emails weren't redacted: %v", emails)
+	}
+
+	// replicas still get the DB's triggers
+	triggers := queryValues(t, db, "SELECT name FROM sqlite_master WHERE type = 'trigger' ORDER BY name")
+	if len(triggers) != 2 || triggers[0] != "audit_email" || triggers[1] != "delete_orders" {
+		t.Errorf("triggers weren't restored: %v", triggers)
+	}
+}
+
+func TestFilterDoesNotFireTriggers(t *testing.T) {
+	path, db := createTestDB(t, auditedSchema)
+
+	view := replicaView{Filters: []ReplicationFilter{{
+		Where: map[string]string{"users": "id = 1"},
+	}}}
+
+	if err := applyView(path, view); err != nil {
+		t.Fatal(err)
+	}
+
+	if users := queryValues(t, db, "SELECT id FROM users"); len(users) != 1 || users[0] != "1" {
+		t.Errorf("filter kept users %v", users)
+	}
+
+	// the filter only asked for users to be filtered
+	if orders := queryValues(t, db, "SELECT id FROM orders ORDER BY id"); len(orders) != 2 {
+		t.Errorf("trigger deleted orders the filter didn't touch, left %v", orders)
+	}
+}
+
+func TestFilterDropsTriggersOfDroppedTables(t *testing.T) {
+	path, db := createTestDB(t, auditedSchema)
+
+	view := replicaView{Filters: []ReplicationFilter{{Exclude: []string{"users"}}}}
+
+	if err := applyView(path, view); err != nil {
+		t.Fatal(err)
+	}
+
+	if triggers := queryValues(t, db, "SELECT name FROM sqlite_master WHERE type = 'trigger'"); len(triggers) > 0 {
+		t.Errorf("triggers of a dropped table were restored: %v", triggers)
+	}
+}
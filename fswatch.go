@@ -0,0 +1,219 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/howeyc/fsnotify"
+)
+
+// fileWatcher shares one fsnotify watcher between all watched DBs and hands
+// each event to the DB the file belongs to. A DB's -wal and -shm files come
+// and go with connections, so they're picked up through the DB's directory
+// rather than watched directly. Events for other files go to the handler of
+// their directory, if it has one.
+type fileWatcher struct {
+	watcher *fsnotify.Watcher
+
+	mu           sync.Mutex
+	handlers     map[string]func(ev *fsnotify.FileEvent)
+	dir_handlers map[string]func(ev *fsnotify.FileEvent)
+	dirs         map[string]int
+}
+
+func newFileWatcher() (*fileWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileWatcher{
+		watcher:      watcher,
+		handlers:     make(map[string]func(ev *fsnotify.FileEvent)),
+		dir_handlers: make(map[string]func(ev *fsnotify.FileEvent)),
+		dirs:         make(map[string]int),
+	}, nil
+}
+
+// add watches the DB at db_path, sending events for it and its -wal and -shm
+// files to handler
+func (fw *fileWatcher) add(db_path string, handler func(ev *fsnotify.FileEvent)) error {
+	db_path = filepath.Clean(db_path)
+	dir := filepath.Dir(db_path)
+
+	if err := fw.watcher.Watch(db_path); err != nil {
+		return err
+	}
+
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	fw.handlers[db_path] = handler
+	fw.handlers[db_path+"-wal"] = handler
+	fw.handlers[db_path+"-shm"] = handler
+
+	if err := fw.watchDir(dir); err != nil {
+		log.Warning("unable to watch directory of %s, WAL commits won't be detected: %s", db_path, err)
+	}
+
+	return nil
+}
+
+func (fw *fileWatcher) remove(db_path string) {
+	db_path = filepath.Clean(db_path)
+	dir := filepath.Dir(db_path)
+
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if _, ok := fw.handlers[db_path]; !ok {
+		return
+	}
+
+	delete(fw.handlers, db_path)
+	delete(fw.handlers, db_path+"-wal")
+	delete(fw.handlers, db_path+"-shm")
+
+	// the watch is already gone if the file was deleted
+	_ = fw.watcher.RemoveWatch(db_path)
+
+	fw.unwatchDir(dir)
+}
+
+// unwatchFile drops the watch on a DB's file while keeping its handler, for
+// when it's gone from its path
+func (fw *fileWatcher) unwatchFile(db_path string) {
+	_ = fw.watcher.RemoveWatch(filepath.Clean(db_path))
+}
+
+// rewatchFile watches whatever file is at a DB's path now, in case it's been
+// replaced
+func (fw *fileWatcher) rewatchFile(db_path string) error {
+	db_path = filepath.Clean(db_path)
+
+	_ = fw.watcher.RemoveWatch(db_path)
+	return fw.watcher.Watch(db_path)
+}
+
+// addFile sends events for a file that isn't a DB to handler. It's watched
+// through its directory, so it's still followed when it's replaced by
+// renaming another file over it.
+func (fw *fileWatcher) addFile(path string, handler func(ev *fsnotify.FileEvent)) error {
+	path = filepath.Clean(path)
+
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if _, ok := fw.handlers[path]; ok {
+		fw.handlers[path] = handler
+		return nil
+	}
+
+	if err := fw.watchDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+	fw.handlers[path] = handler
+
+	return nil
+}
+
+// addDir sends events for files in dir that don't belong to a watched DB to
+// handler
+func (fw *fileWatcher) addDir(dir string, handler func(ev *fsnotify.FileEvent)) error {
+	dir = filepath.Clean(dir)
+
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if _, ok := fw.dir_handlers[dir]; ok {
+		return nil
+	}
+
+	if err := fw.watchDir(dir); err != nil {
+		return err
+	}
+	fw.dir_handlers[dir] = handler
+
+	return nil
+}
+
+func (fw *fileWatcher) removeDir(dir string) {
+	dir = filepath.Clean(dir)
+
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if _, ok := fw.dir_handlers[dir]; !ok {
+		return
+	}
+
+	delete(fw.dir_handlers, dir)
+	fw.unwatchDir(dir)
+}
+
+// watchedDirs returns the directories with handlers at or below dir
+func (fw *fileWatcher) watchedDirs(dir string) []string {
+	dir = filepath.Clean(dir)
+
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	var dirs []string
+	for watched := range fw.dir_handlers {
+		if watched == dir || strings.HasPrefix(watched, dir+string(filepath.Separator)) {
+			dirs = append(dirs, watched)
+		}
+	}
+
+	return dirs
+}
+
+// watchDir and unwatchDir keep count of who needs a directory watched, and
+// must be called with mu held
+func (fw *fileWatcher) watchDir(dir string) error {
+	if fw.dirs[dir] == 0 {
+		if err := fw.watcher.Watch(dir); err != nil {
+			return err
+		}
+	}
+	fw.dirs[dir]++
+
+	return nil
+}
+
+func (fw *fileWatcher) unwatchDir(dir string) {
+	if fw.dirs[dir] == 0 {
+		return
+	}
+
+	fw.dirs[dir]--
+	if fw.dirs[dir] == 0 {
+		delete(fw.dirs, dir)
+		_ = fw.watcher.RemoveWatch(dir)
+	}
+}
+
+// run dispatches events until watching fails
+func (fw *fileWatcher) run() {
+	for {
+		select {
+		case ev := <-fw.watcher.Event:
+			name := filepath.Clean(ev.Name)
+
+			fw.mu.Lock()
+			handler, ok := fw.handlers[name]
+			if !ok {
+				handler = fw.dir_handlers[filepath.Dir(name)]
+			}
+			fw.mu.Unlock()
+
+			if handler != nil {
+				handler(ev)
+			}
+		case err := <-fw.watcher.Error:
+			log.Error("error watching file: %s", err)
+			return
+		}
+	}
+}
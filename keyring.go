@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/dkulchenko/watchdb/ssl"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Identity is a replica allowed to sync, known by name in the logs and
+// authenticated with a secret of its own, or a client certificate issued to
+// its name. Only a SHA-256 hash of the secret is kept in the config, and it
+// can be left out for identities that only use certificates. Databases limits
+// which DBs it can sync (by name, or a pattern like reports/*), and Filter and
+// Redaction are applied to everything it's sent.
+type Identity struct {
+	Name         string   `yaml:"name"`
+	SecretSHA256 string   `yaml:"secret_sha256"`
+	Databases    []string `yaml:"databases,omitempty"`
+	Disabled     bool     `yaml:"disabled,omitempty"`
+	Filter       string   `yaml:"filter,omitempty"`
+	Redaction    string   `yaml:"redaction,omitempty"`
+
+	// X25519 public key (base64) everything sent to it is encrypted for
+	Recipient string `yaml:"recipient,omitempty"`
+}
+
+// the identity syncers with the plain auth_key are logged as
+const authKeyIdentity = "auth_key"
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func (id *Identity) allowed(db_name string) bool {
+	if len(id.Databases) == 0 {
+		return true
+	}
+
+	for _, pattern := range id.Databases {
+		if matched, _ := path.Match(pattern, db_name); matched || pattern == db_name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// keyring is the set of identities the watcher accepts, which can be
+// replaced while it's running
+type keyring struct {
+	mu         sync.RWMutex
+	identities []*Identity
+	hashes     [][]byte
+}
+
+var replicaKeyring = &keyring{}
+
+// checkIdentities makes sure every identity can be told apart and logged in
+// with
+func checkIdentities(identities []Identity) error {
+	names := make(map[string]bool)
+	secrets := make(map[string]bool)
+
+	for i, id := range identities {
+		if id.Name == "" {
+			return fmt.Errorf("keyring entry %d has no name", i+1)
+		}
+		if id.Name == authKeyIdentity || names[id.Name] {
+			return fmt.Errorf("there's more than one identity named '%s' in the keyring", id.Name)
+		}
+		names[id.Name] = true
+
+		if id.Recipient != "" {
+			if _, err := parseRecipient(id.Recipient); err != nil {
+				return fmt.Errorf("identity %s has an invalid recipient (see watchdb encryption-key new): %s", id.Name, err)
+			}
+		}
+
+		// identities without a secret can only log in with a certificate
+		if id.SecretSHA256 == "" {
+			continue
+		}
+
+		hash := strings.ToLower(id.SecretSHA256)
+		if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != sha256.Size {
+			return fmt.Errorf("identity %s needs a secret_sha256 of 64 hex digits (see watchdb keyring new)", id.Name)
+		}
+		if secrets[hash] {
+			return fmt.Errorf("identity %s has the same secret as another identity", id.Name)
+		}
+		secrets[hash] = true
+	}
+
+	return nil
+}
+
+// load replaces the identities in the keyring with those in options, along
+// with one for the plain auth key if there is one
+func (k *keyring) load(options WatchConfig) {
+	var identities []*Identity
+	var hashes [][]byte
+
+	if options.AuthKey != "" {
+		id := &Identity{Name: authKeyIdentity, SecretSHA256: hashSecret(options.AuthKey)}
+		identities = append(identities, id)
+
+		hash, _ := hex.DecodeString(id.SecretSHA256)
+		hashes = append(hashes, hash)
+	}
+
+	for i := range options.Keyring {
+		id := options.Keyring[i]
+		id.SecretSHA256 = strings.ToLower(id.SecretSHA256)
+		identities = append(identities, &id)
+
+		// empty for identities that only use certificates
+		hash, _ := hex.DecodeString(id.SecretSHA256)
+		hashes = append(hashes, hash)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.identities = identities
+	k.hashes = hashes
+}
+
+// authenticate returns the identity secret belongs to, or nil if it doesn't
+// belong to any. The secret's hash is compared against every identity in
+// constant time, so timing gives away neither how close a guess was nor
+// which identity it was close to.
+func (k *keyring) authenticate(secret string) (id *Identity, required bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if len(k.identities) == 0 {
+		return nil, false
+	}
+
+	hash, _ := hex.DecodeString(hashSecret(secret))
+
+	for i, known := range k.hashes {
+		if len(known) > 0 && subtle.ConstantTimeCompare(hash, known) == 1 {
+			id = k.identities[i]
+		}
+	}
+
+	return id, true
+}
+
+func (k *keyring) list() []*Identity {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.identities
+}
+
+func (k *keyring) byName(name string) *Identity {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	for _, id := range k.identities {
+		if id.Name == name {
+			return id
+		}
+	}
+
+	return nil
+}
+
+// authorized checks the secret a request came with, and the client
+// certificate it was made with, returning the identity they belong to (nil
+// when no auth is required and there's no certificate). Rejections are
+// logged by identity, never with the secret that was sent.
+func authorized(w http.ResponseWriter, r *http.Request) (*Identity, bool) {
+	id, required := replicaKeyring.authenticate(r.Header.Get("Authorization"))
+
+	// certificates are only accepted once verified against the client CA, so
+	// the name they're issued to can be trusted
+	peer := ssl.PeerName(r.TLS)
+	if peer != "" {
+		known := replicaKeyring.byName(peer)
+
+		switch {
+		case id == nil && known != nil:
+			id = known
+		case id != nil && known != nil && known != id:
+			log.Warning("audit: rejected %s from %s, certificate for %s used with the auth key of %s", r.URL.Path, r.RemoteAddr, peer, id.Name)
+			http.Error(w, "certificate doesn't match auth key", 403)
+			metricAuthFailures.inc("certificate_mismatch")
+			return nil, false
+		case id == nil && required:
+			log.Warning("audit: rejected %s from %s, certificate for unknown identity %s", r.URL.Path, r.RemoteAddr, peer)
+			http.Error(w, "certificate isn't for a known identity", 403)
+			metricAuthFailures.inc("unknown_certificate")
+			return nil, false
+		case id == nil:
+			// nothing to authorize, but it's still worth knowing who it was
+			id = &Identity{Name: peer}
+		}
+	}
+
+	if !required {
+		return id, true
+	}
+
+	if id == nil {
+		log.Warning("audit: rejected %s from %s, unknown auth key", r.URL.Path, r.RemoteAddr)
+		http.Error(w, "authorization required", 401)
+		metricAuthFailures.inc("unknown_key")
+		return nil, false
+	}
+
+	if id.Disabled {
+		log.Warning("audit: rejected %s from %s, identity %s is disabled", r.URL.Path, r.RemoteAddr, id.Name)
+		http.Error(w, "identity is disabled", 403)
+		metricAuthFailures.inc("disabled")
+		return nil, false
+	}
+
+	return id, true
+}
+
+// allowedDatabase checks that the identity a request was authorized as can
+// sync db, and logs the access
+func allowedDatabase(w http.ResponseWriter, r *http.Request, id *Identity, db *watchedDB, endpoint string) bool {
+	if id == nil {
+		return true
+	}
+
+	if !id.allowed(db.name) {
+		log.Warning("audit: denied %s access to %s from %s, %s isn't in its databases", id.Name, db.name, r.RemoteAddr, db.name)
+		http.Error(w, fmt.Sprintf("not allowed to sync database '%s'", db.name), 403)
+		metricAuthFailures.inc("database_not_allowed")
+		return false
+	}
+
+	log.Info("audit: %s requested %s of %s from %s", id.Name, endpoint, db.name, r.RemoteAddr)
+
+	return true
+}
+
+// handleReload reloads the keyring from the config file on SIGHUP, so
+// replicas can be added, disabled or removed without a restart. Everything
+// else in the config still needs one.
+func handleReload(options WatchConfig) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for range signals {
+			if options.ConfigFile == "" {
+				log.Warning("received SIGHUP, but there's no config file to reload the keyring from")
+				continue
+			}
+
+			reloaded, err := reloadKeyring(options)
+			if err != nil {
+				log.Error("unable to reload keyring, keeping the current one: %s", err)
+				continue
+			}
+
+			options = reloaded
+			replicaKeyring.load(options)
+			log.Notice("reloaded keyring from %s (%d identities)", options.ConfigFile, len(options.Keyring))
+		}
+	}()
+}
+
+func reloadKeyring(options WatchConfig) (WatchConfig, error) {
+	data, err := ioutil.ReadFile(options.ConfigFile)
+	if err != nil {
+		return options, err
+	}
+
+	var config WatchConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return options, err
+	}
+
+	options.Keyring = config.Keyring
+
+	// identities can only use filters and profiles the watcher started with
+	if err := checkViews(options); err != nil {
+		return options, err
+	}
+
+	return options, nil
+}
+
+// runKeyring handles the keyring subcommands, which help with setting up
+// identities
+func runKeyring(arguments map[string]interface{}) {
+	switch {
+	case arguments["new"].(bool):
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatalf("unable to generate secret: %s", err)
+		}
+		encoded := hex.EncodeToString(secret)
+
+		fmt.Printf("secret for %s (pass it to the replica with --auth-key, it isn't stored anywhere):\n\n", arguments["<name>"])
+		fmt.Printf("  %s\n\n", encoded)
+		fmt.Printf("keyring entry for the watcher's config file:\n\n")
+		fmt.Printf("  - name: %s\n    secret_sha256: %s\n", arguments["<name>"], hashSecret(encoded))
+	case arguments["hash"].(bool):
+		// read from stdin, so the secret doesn't end up in shell history
+		scanner := bufio.NewScanner(os.Stdin)
+		if !scanner.Scan() {
+			log.Fatal("no secret given on stdin")
+		}
+
+		fmt.Println(hashSecret(strings.TrimSpace(scanner.Text())))
+	}
+}
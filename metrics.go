@@ -0,0 +1,445 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics are kept in a small registry of our own and served at /metrics in
+// the Prometheus text format, by the watcher and by a syncer's status server.
+// Families without any samples yet are left out, so each only shows what it
+// does.
+
+type metricFamily interface {
+	write(w io.Writer)
+}
+
+type metricRegistry struct {
+	mu       sync.Mutex
+	families []metricFamily
+}
+
+var metrics = &metricRegistry{}
+
+func (r *metricRegistry) register(family metricFamily) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.families = append(r.families, family)
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	metrics.mu.Lock()
+	families := append([]metricFamily(nil), metrics.families...)
+	metrics.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, family := range families {
+		family.write(w)
+	}
+}
+
+// metricSeries is one set of label values, kept as a key of the values
+// joined together
+type metricSeries struct {
+	labels []string
+	key    string
+}
+
+func seriesOf(label_values []string) metricSeries {
+	return metricSeries{labels: label_values, key: strings.Join(label_values, "\xff")}
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// formatLabels renders names and values as {name="value",...}, with any
+// extra pair (like a histogram's le) at the end
+func formatLabels(names []string, values []string, extra ...string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escapeLabel(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], escapeLabel(extra[i+1])))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func writeHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// valueVec is a counter or gauge, by label values
+type valueVec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]metricSeries
+	values map[string]float64
+}
+
+func newValueVec(name string, help string, kind string, labels []string) *valueVec {
+	v := &valueVec{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		series: make(map[string]metricSeries),
+		values: make(map[string]float64),
+	}
+	metrics.register(v)
+
+	return v
+}
+
+func newCounter(name string, help string, labels ...string) *valueVec {
+	return newValueVec(name, help, "counter", labels)
+}
+
+func newGauge(name string, help string, labels ...string) *valueVec {
+	return newValueVec(name, help, "gauge", labels)
+}
+
+func (v *valueVec) add(value float64, label_values ...string) {
+	series := seriesOf(label_values)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.series[series.key] = series
+	v.values[series.key] += value
+}
+
+func (v *valueVec) inc(label_values ...string) {
+	v.add(1, label_values...)
+}
+
+func (v *valueVec) set(value float64, label_values ...string) {
+	series := seriesOf(label_values)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.series[series.key] = series
+	v.values[series.key] = value
+}
+
+// forget drops a series, for things that are no longer around
+func (v *valueVec) forget(label_values ...string) {
+	key := seriesOf(label_values).key
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	delete(v.series, key)
+	delete(v.values, key)
+}
+
+func (v *valueVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if len(v.values) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	writeHeader(w, v.name, v.help, v.kind)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, v.series[key].labels), formatValue(v.values[key]))
+	}
+}
+
+// metricSample is one value of a gaugeFunc
+type metricSample struct {
+	labels []string
+	value  float64
+}
+
+// gaugeFunc is a gauge that's read when it's scraped, for values that are
+// already kept somewhere else
+type gaugeFunc struct {
+	name   string
+	help   string
+	labels []string
+	read   func() []metricSample
+}
+
+func newGaugeFunc(name string, help string, labels []string, read func() []metricSample) *gaugeFunc {
+	g := &gaugeFunc{name: name, help: help, labels: labels, read: read}
+	metrics.register(g)
+
+	return g
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	samples := g.read()
+	if len(samples) == 0 {
+		return
+	}
+
+	writeHeader(w, g.name, g.help, "gauge")
+	for _, sample := range samples {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, sample.labels), formatValue(sample.value))
+	}
+}
+
+// durations from a few milliseconds up to a few minutes
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+type histogramSeries struct {
+	series metricSeries
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+func newHistogram(name string, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+	metrics.register(h)
+
+	return h
+}
+
+func (h *histogramVec) observe(value float64, label_values ...string) {
+	series := seriesOf(label_values)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[series.key]
+	if !ok {
+		s = &histogramSeries{series: series, counts: make([]uint64, len(h.buckets))}
+		h.series[series.key] = s
+	}
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+// since observes how long it's been since start, in seconds
+func (h *histogramVec) since(start time.Time, label_values ...string) {
+	h.observe(time.Since(start).Seconds(), label_values...)
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.series) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	writeHeader(w, h.name, h.help, "histogram")
+	for _, key := range keys {
+		s := h.series[key]
+		values := s.series.labels
+
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, "le", formatValue(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, values), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, values), s.count)
+	}
+}
+
+// the watcher's metrics
+var (
+	metricChanges = newCounter("watchdb_changes_detected_total",
+		"Changes to a watched DB's contents, each of which got a new version.", "db")
+	metricNotifications = newCounter("watchdb_notifications_sent_total",
+		"Change notifications sent to connected syncers.", "db")
+	metricSnapshotDuration = newHistogram("watchdb_snapshot_duration_seconds",
+		"Time taken to snapshot a watched DB after it changed.", durationBuckets, "db")
+	metricSnapshotSize = newGauge("watchdb_snapshot_size_bytes",
+		"Size of the current snapshot of a watched DB.", "db")
+	metricBytesServed = newCounter("watchdb_bytes_served_total",
+		"Bytes sent to syncers, after compression (and encryption).", "db", "endpoint")
+	metricBytesUncompressed = newCounter("watchdb_bytes_uncompressed_total",
+		"Bytes sent to syncers, before compression.", "db", "endpoint")
+	metricAuthFailures = newCounter("watchdb_auth_failures_total",
+		"Requests rejected for failing authentication or authorization.", "reason")
+
+	_ = newGaugeFunc("watchdb_compression_ratio",
+		"Bytes before compression for each byte sent to syncers, so far.", []string{"db", "endpoint"}, compressionRatios)
+	_ = newGaugeFunc("watchdb_connected_syncers",
+		"Syncers connected for change notifications.", []string{"db"}, func() []metricSample {
+			var samples []metricSample
+			for _, db := range databases.list() {
+				samples = append(samples, metricSample{labels: []string{db.name}, value: float64(db.subscribers.Len())})
+			}
+			return samples
+		})
+	_ = newGaugeFunc("watchdb_db_version",
+		"Current version of a watched DB.", []string{"db"}, func() []metricSample {
+			var samples []metricSample
+			for _, db := range databases.list() {
+				if current := db.acquireSnapshot(); current != nil {
+					samples = append(samples, metricSample{labels: []string{db.name}, value: float64(current.version)})
+					current.release()
+				}
+			}
+			return samples
+		})
+)
+
+// the syncer's metrics
+var (
+	metricSyncs = newCounter("watchdb_syncs_total",
+		"Syncs that brought a local DB up to date (or found it already was).", "replica")
+	metricSyncFailures = newCounter("watchdb_sync_failures_total",
+		"Syncs that failed, by what went wrong.", "replica", "reason")
+	metricDownloadDuration = newHistogram("watchdb_sync_download_duration_seconds",
+		"Time taken to download an update from upstream.", durationBuckets, "replica", "method")
+	metricImportDuration = newHistogram("watchdb_sync_import_duration_seconds",
+		"Time taken to import a downloaded update and swap it in.", durationBuckets, "replica", "method")
+	metricBytesReceived = newCounter("watchdb_sync_bytes_received_total",
+		"Bytes of updates received from upstream, after decompression.", "replica", "method")
+
+	_ = newGaugeFunc("watchdb_replica_version",
+		"Upstream version a local DB was last synced to.", []string{"replica"}, func() []metricSample {
+			return replicaSamples(func(s replicaState) float64 { return float64(s.version) })
+		})
+	_ = newGaugeFunc("watchdb_replica_upstream_version",
+		"Newest version upstream has announced for a local DB.", []string{"replica"}, func() []metricSample {
+			return replicaSamples(func(s replicaState) float64 { return float64(s.upstream_version) })
+		})
+	_ = newGaugeFunc("watchdb_replica_lag_seconds",
+		"How long a local DB has been behind upstream (or out of touch with it), 0 while it's current.", []string{"replica"}, func() []metricSample {
+			return replicaSamples(func(s replicaState) float64 { return s.lag.Seconds() })
+		})
+	_ = newGaugeFunc("watchdb_replica_connected",
+		"Whether a local DB's syncer is connected to upstream.", []string{"replica"}, func() []metricSample {
+			return replicaSamples(func(s replicaState) float64 {
+				if s.connected {
+					return 1
+				}
+				return 0
+			})
+		})
+)
+
+func compressionRatios() []metricSample {
+	metricBytesServed.mu.Lock()
+	sent := make(map[string]float64, len(metricBytesServed.values))
+	for key, value := range metricBytesServed.values {
+		sent[key] = value
+	}
+	metricBytesServed.mu.Unlock()
+
+	metricBytesUncompressed.mu.Lock()
+	defer metricBytesUncompressed.mu.Unlock()
+
+	var samples []metricSample
+	for key, uncompressed := range metricBytesUncompressed.values {
+		if sent[key] > 0 {
+			samples = append(samples, metricSample{labels: metricBytesUncompressed.series[key].labels, value: uncompressed / sent[key]})
+		}
+	}
+
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].labels, "\xff") < strings.Join(samples[j].labels, "\xff")
+	})
+
+	return samples
+}
+
+func replicaSamples(value func(replicaState) float64) []metricSample {
+	var samples []metricSample
+	for _, status := range replicas.list() {
+		samples = append(samples, metricSample{labels: []string{status.path}, value: value(status.state())})
+	}
+
+	return samples
+}
+
+// syncError is a failed sync, along with what kind of failure it was for
+// watchdb_sync_failures_total
+type syncError struct {
+	reason string
+	err    error
+}
+
+func (e *syncError) Error() string {
+	return e.err.Error()
+}
+
+func syncFailure(reason string, format string, args ...interface{}) error {
+	return &syncError{reason: reason, err: fmt.Errorf(format, args...)}
+}
+
+// wrapFailure adds context to err while keeping what kind of failure it was,
+// which is taken to be reason if err doesn't say
+func wrapFailure(err error, reason string, format string, args ...interface{}) error {
+	if known := failureReason(err); known != "other" {
+		reason = known
+	}
+
+	return syncFailure(reason, format, args...)
+}
+
+// failureReason sorts a failed sync into one of a few kinds, for counting
+func failureReason(err error) string {
+	switch err := err.(type) {
+	case *syncError:
+		return err.reason
+	case net.Error:
+		return "network"
+	}
+
+	return "other"
+}
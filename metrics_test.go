@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestFailureReason(t *testing.T) {
+	network := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+
+	for _, test := range []struct {
+		err    error
+		reason string
+	}{
+		{errUnauthorized, "unauthorized"},
+		{errNotEncrypted, "decryption"},
+		{errUndecryptable, "decryption"},
+		{errUnsigned, "signature"},
+		{errBadSignature, "signature"},
+		{errDigestMismatch, "verification"},
+		{syncFailure("upstream", "upstream returned %s", "500 Internal Server Error"), "upstream"},
+		{network, "network"},
+		{wrapFailure(network, "verification", "truncated page data from upstream: %s", network), "network"},
+		{wrapFailure(errTruncatedPayload, "network", "unable to download latest DB: %s", errTruncatedPayload), "decryption"},
+		{wrapFailure(errors.New("unexpected EOF"), "verification", "truncated page data from upstream: unexpected EOF"), "verification"},
+		// messages don't decide the kind of failure
+		{errors.New("checksum mismatch, unable to import or back up"), "other"},
+	} {
+		if reason := failureReason(test.err); reason != test.reason {
+			t.Errorf("%q sorted as %s, expected %s", test.err, reason, test.reason)
+		}
+	}
+}
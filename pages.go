@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// number of database pages hashed (and shipped) together as one range
+const pagesPerRange = 16
+
+var sqliteHeader = []byte("SQLite format 3\x00")
+
+var errPagesUnsupported = errors.New("upstream doesn't support page-level sync")
+var errSnapshotChanged = errors.New("upstream snapshot changed during sync")
+
+type pageManifest struct {
+	Id        string   `json:"id"`
+	Version   uint64   `json:"version"`
+	PageSize  int64    `json:"page_size"`
+	RangeSize int64    `json:"range_size"`
+	Size      int64    `json:"size"`
+	Hashes    []string `json:"hashes"`
+
+	// redaction profile the snapshot was built with, if any
+	Redaction string `json:"redaction,omitempty"`
+}
+
+func readPageSize(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	header := make([]byte, 100)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return 0, fmt.Errorf("%s is not a sqlite database", path)
+	}
+
+	if !bytes.Equal(header[:len(sqliteHeader)], sqliteHeader) {
+		return 0, fmt.Errorf("%s is not a sqlite database", path)
+	}
+
+	page_size := int64(binary.BigEndian.Uint16(header[16:18]))
+	if page_size == 1 {
+		page_size = 65536
+	}
+
+	return page_size, nil
+}
+
+func buildPageManifest(path string, page_size int64) (*pageManifest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	manifest := &pageManifest{
+		PageSize:  page_size,
+		RangeSize: page_size * pagesPerRange,
+	}
+
+	all := md5.New()
+	buf := make([]byte, manifest.RangeSize)
+	for {
+		n, err := io.ReadFull(file, buf)
+		if n > 0 {
+			sum := md5.Sum(buf[:n])
+			manifest.Hashes = append(manifest.Hashes, hex.EncodeToString(sum[:]))
+			manifest.Size += int64(n)
+			all.Write(sum[:])
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	manifest.Id = hex.EncodeToString(all.Sum(nil))
+
+	return manifest, nil
+}
+
+func servePages(w http.ResponseWriter, r *http.Request, db *watchedDB, view replicaView, client *Identity) {
+	current, err := db.acquireView(view)
+	if err != nil {
+		log.Error("unable to build view of %s for %s: %s", db.name, r.RemoteAddr, err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if current == nil {
+		http.Error(w, "no snapshot available yet", 503)
+		return
+	}
+	defer current.release()
+
+	setVersionHeaders(w, current)
+
+	if r.Method == "GET" {
+		if notModified(r, current) {
+			w.WriteHeader(304)
+			return
+		}
+
+		data, err := json.Marshal(current.manifest)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		startSignedResponse(w)
+
+		// page hashes give away which pages are the same, so the manifest is
+		// encrypted along with the pages
+		sent := &countingWriter{w: w}
+
+		out, err := encodeResponse(w, r, client, sent)
+		if err != nil {
+			log.Error("unable to encrypt manifest of %s for %s: %s", db.name, r.RemoteAddr, err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		digest := newPayloadDigest()
+		io.MultiWriter(out, digest).Write(data)
+		err = out.Close()
+
+		metricBytesServed.add(float64(sent.n), db.name, "pages")
+		metricBytesUncompressed.add(float64(digest.n), db.name, "pages")
+
+		if err != nil {
+			return
+		}
+
+		finishSignedResponse(w, "pages", current, digest, client)
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+
+	if r.URL.Query().Get("id") != current.manifest.Id {
+		http.Error(w, errSnapshotChanged.Error(), 409)
+		return
+	}
+
+	file, err := os.Open(current.path)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer file.Close()
+
+	var ranges []int
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		index, err := strconv.Atoi(line)
+		if err != nil || index < 0 || index >= len(current.manifest.Hashes) {
+			http.Error(w, fmt.Sprintf("invalid range: %s", line), 400)
+			return
+		}
+
+		ranges = append(ranges, index)
+	}
+
+	log.Debug("sending %d changed page ranges of %s to %s", len(ranges), db.name, r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	startSignedResponse(w)
+
+	sent := &countingWriter{w: w}
+
+	encoded, err := encodeResponse(w, r, client, sent)
+	if err != nil {
+		log.Error("unable to encrypt pages of %s for %s: %s", db.name, r.RemoteAddr, err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	digest := newPayloadDigest()
+	out := io.MultiWriter(encoded, digest)
+
+	// counted even if the syncer goes away partway through
+	defer func() {
+		metricBytesServed.add(float64(sent.n), db.name, "page-data")
+		metricBytesUncompressed.add(float64(digest.n), db.name, "page-data")
+	}()
+
+	buf := make([]byte, current.manifest.RangeSize)
+	header := make([]byte, 8)
+	for _, index := range ranges {
+		n, err := file.ReadAt(buf, int64(index)*current.manifest.RangeSize)
+		if err != nil && err != io.EOF {
+			log.Error("unable to read page range from snapshot: %s", err)
+			return
+		}
+
+		binary.BigEndian.PutUint32(header[0:4], uint32(index))
+		binary.BigEndian.PutUint32(header[4:8], uint32(n))
+
+		if _, err := out.Write(header); err != nil {
+			return
+		}
+		if _, err := out.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+
+	if err := encoded.Close(); err != nil {
+		return
+	}
+
+	finishSignedResponse(w, "page-data", current, digest, client)
+}
+
+func fetchManifest(client *http.Client, pages_url string, options WatchConfig) (*pageManifest, error) {
+	req, err := http.NewRequest("GET", pages_url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if options.AuthKey != "" {
+		req.Header.Add("Authorization", options.AuthKey)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 404 {
+		return nil, errPagesUnsupported
+	}
+	if resp.StatusCode != 200 {
+		return nil, syncFailure("upstream", "upstream returned %s", resp.Status)
+	}
+
+	body, err := decodeResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := newPayloadDigest()
+	data, err := ioutil.ReadAll(io.TeeReader(body, digest))
+	if err != nil {
+		return nil, wrapFailure(err, "network", "unable to download page manifest: %s", err)
+	}
+
+	if err := verifyPayload(resp, "pages", digest, options); err != nil {
+		return nil, err
+	}
+
+	manifest := &pageManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, syncFailure("upstream", "invalid page manifest from upstream: %s", err)
+	}
+
+	return manifest, nil
+}
+
+// syncPages brings the local DB up to date by fetching only the page ranges
+// that differ from upstream. If the local DB is missing or has a different
+// page size, every range is fetched. The ranges are applied to a copy of the
+// DB that replaces it once verified.
+func syncPages(client *http.Client, pages_url string, path string, options WatchConfig) error {
+	start := time.Now()
+
+	remote, err := fetchManifest(client, pages_url, options)
+	if err != nil {
+		return err
+	}
+
+	full := true
+	local := &pageManifest{}
+
+	if page_size, err := readPageSize(path); err == nil && page_size == remote.PageSize {
+		local, err = buildPageManifest(path, remote.PageSize)
+		if err != nil {
+			return err
+		}
+		full = false
+	} else if dbexists, _ := exists(path); dbexists {
+		log.Info("local DB doesn't match upstream page size, doing a full transfer")
+	}
+
+	var changed []string
+	for index, hash := range remote.Hashes {
+		if index >= len(local.Hashes) || local.Hashes[index] != hash {
+			changed = append(changed, strconv.Itoa(index))
+		}
+	}
+
+	if len(changed) == 0 && local.Size == remote.Size {
+		log.Debug("local DB already matches upstream version %d", remote.Version)
+		writeReplicaVersion(path, remote.Version, remote.Id, remote.Redaction)
+		return nil
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s?id=%s", pages_url, remote.Id), strings.NewReader(strings.Join(changed, "\n")))
+	if err != nil {
+		return err
+	}
+	if options.AuthKey != "" {
+		req.Header.Add("Authorization", options.AuthKey)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 409 {
+		return errSnapshotChanged
+	}
+	if resp.StatusCode != 200 {
+		return syncFailure("upstream", "upstream returned %s", resp.Status)
+	}
+
+	// ranges are patched into a copy of the DB, which is swapped in once complete
+	import_path := importPath(path)
+	_ = os.Remove(import_path)
+	defer os.Remove(import_path)
+
+	if !full {
+		if err := copyFileContents(path, import_path); err != nil {
+			return syncFailure("import", "unable to copy DB prior to import: %s", err)
+		}
+	}
+
+	out, err := os.OpenFile(import_path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	decoded, err := decodeResponse(resp)
+	if err != nil {
+		return err
+	}
+
+	digest := newPayloadDigest()
+	body := bufio.NewReader(io.TeeReader(decoded, digest))
+	header := make([]byte, 8)
+	buf := make([]byte, remote.RangeSize)
+	received := 0
+
+	for {
+		if _, err := io.ReadFull(body, header); err == io.EOF {
+			break
+		} else if err != nil {
+			return wrapFailure(err, "verification", "truncated page data from upstream: %s", err)
+		}
+
+		index := int(binary.BigEndian.Uint32(header[0:4]))
+		length := int64(binary.BigEndian.Uint32(header[4:8]))
+
+		if index >= len(remote.Hashes) || length > remote.RangeSize {
+			return syncFailure("verification", "invalid page range %d from upstream", index)
+		}
+
+		if _, err := io.ReadFull(body, buf[:length]); err != nil {
+			return wrapFailure(err, "verification", "truncated page data from upstream: %s", err)
+		}
+
+		sum := md5.Sum(buf[:length])
+		if hex.EncodeToString(sum[:]) != remote.Hashes[index] {
+			return syncFailure("verification", "checksum mismatch on page range %d", index)
+		}
+
+		if _, err := out.WriteAt(buf[:length], int64(index)*remote.RangeSize); err != nil {
+			return err
+		}
+
+		received++
+	}
+
+	if received != len(changed) {
+		return syncFailure("verification", "expected %d page ranges from upstream, got %d", len(changed), received)
+	}
+
+	if err := verifyPayload(resp, "page-data", digest, options); err != nil {
+		return err
+	}
+	metricDownloadDuration.since(start, path, "pages")
+	metricBytesReceived.add(float64(digest.n), path, "pages")
+
+	import_start := time.Now()
+
+	if err := out.Truncate(remote.Size); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	out.Close()
+
+	if err := backupReplica(path, options); err != nil {
+		return err
+	}
+
+	if err := replaceReplica(import_path, path); err != nil {
+		return err
+	}
+	metricImportDuration.since(import_start, path, "pages")
+
+	writeReplicaVersion(path, remote.Version, remote.Id, remote.Redaction)
+	archiveReplica(path, remote.Version, remote.Id, remote.Redaction, options)
+
+	log.Info("updated %s with latest (version %d, %d of %d page ranges changed)", path, remote.Version, received, len(remote.Hashes))
+
+	return nil
+}
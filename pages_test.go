@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const pagedSchema = `
+CREATE TABLE t(id INTEGER PRIMARY KEY, data BLOB);
+WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 2000)
+INSERT INTO t SELECT i, randomblob(300) FROM n;
+`
+
+// pagesServer serves a watched DB's pages, and keeps the ranges each POST
+// asked for. before, if set, is called with each request first and can
+// change it.
+type pagesServer struct {
+	db     *watchedDB
+	before func(r *http.Request)
+
+	mu        sync.Mutex
+	requested [][]string
+}
+
+func (p *pagesServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.before != nil {
+		p.before(r)
+	}
+
+	if r.Method == "POST" {
+		body, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		p.mu.Lock()
+		p.requested = append(p.requested, strings.Fields(string(body)))
+		p.mu.Unlock()
+	}
+
+	servePages(w, r, p.db, replicaView{}, nil)
+}
+
+func (p *pagesServer) lastRequested() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.requested) == 0 {
+		return nil
+	}
+	return p.requested[len(p.requested)-1]
+}
+
+func newPagesServer(t *testing.T, script string) (*pagesServer, Database, string) {
+	db, source := watchTestDB(t, script)
+	if _, err := db.refreshSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	pages := &pagesServer{db: db}
+	server := httptest.NewServer(pages)
+	t.Cleanup(server.Close)
+
+	return pages, source, server.URL + "/pages"
+}
+
+// change writes script to the watched DB and takes a new snapshot of it
+func (p *pagesServer) change(t *testing.T, source Database, script string) {
+	if err := source.Exec(script); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.db.refreshSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkReplica makes sure the replica has the same rows as the watched DB
+// and records its current version
+func (p *pagesServer) checkReplica(t *testing.T, source Database, replica_path string) {
+	replica, err := openDatabase(replica_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.Close()
+
+	if err := replica.IntegrityCheck(); err != nil {
+		t.Fatalf("replica failed its integrity check: %s", err)
+	}
+
+	query := "SELECT count(*), group_concat(hex(data), '') FROM (SELECT data FROM t ORDER BY id)"
+
+	expected := queryRow(t, source, query)
+	if got := queryRow(t, replica, query); got != expected {
+		t.Errorf("replica doesn't have the watched DB's rows")
+	}
+
+	current := p.db.acquireSnapshot()
+	defer current.release()
+
+	if version, hash := readReplicaVersion(replica_path); version != current.version || hash != current.Hash() {
+		t.Errorf("replica records version %d (%s), expected %d (%s)", version, hash, current.version, current.Hash())
+	}
+}
+
+func queryRow(t *testing.T, db Database, query string) string {
+	rows, err := db.Query(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var values []string
+	for _, row := range rows {
+		for _, value := range row {
+			values = append(values, asString(value))
+		}
+	}
+
+	return strings.Join(values, "|")
+}
+
+func TestSyncPages(t *testing.T) {
+	pages, source, pages_url := newPagesServer(t, pagedSchema)
+	replica_path := filepath.Join(t.TempDir(), "replica.db")
+	options := WatchConfig{NoBackup: true}
+
+	if err := syncPages(http.DefaultClient, pages_url, replica_path, options); err != nil {
+		t.Fatal(err)
+	}
+	pages.checkReplica(t, source, replica_path)
+
+	current := pages.db.acquireSnapshot()
+	ranges := len(current.manifest.Hashes)
+	current.release()
+
+	if requested := len(pages.lastRequested()); requested != ranges {
+		t.Errorf("fresh replica asked for %d of %d page ranges", requested, ranges)
+	}
+
+	// one changed row only changes a couple of ranges (its page's, and the
+	// header's)
+	pages.change(t, source, "UPDATE t SET data = randomblob(300) WHERE id = 1000;")
+
+	if err := syncPages(http.DefaultClient, pages_url, replica_path, options); err != nil {
+		t.Fatal(err)
+	}
+	pages.checkReplica(t, source, replica_path)
+
+	if requested := len(pages.lastRequested()); requested == 0 || requested > 3 {
+		t.Errorf("replica asked for %d of %d page ranges after one row changed", requested, ranges)
+	}
+
+	// nothing left to fetch
+	posts := len(pages.requested)
+	if err := syncPages(http.DefaultClient, pages_url, replica_path, options); err != nil {
+		t.Fatal(err)
+	}
+	if len(pages.requested) != posts {
+		t.Error("replica that's up to date asked for page ranges")
+	}
+}
+
+func TestSyncPagesShrinks(t *testing.T) {
+	pages, source, pages_url := newPagesServer(t, pagedSchema)
+	replica_path := filepath.Join(t.TempDir(), "replica.db")
+	options := WatchConfig{NoBackup: true}
+
+	if err := syncPages(http.DefaultClient, pages_url, replica_path, options); err != nil {
+		t.Fatal(err)
+	}
+
+	pages.change(t, source, "DELETE FROM t WHERE id > 100; VACUUM;")
+
+	if err := syncPages(http.DefaultClient, pages_url, replica_path, options); err != nil {
+		t.Fatal(err)
+	}
+	pages.checkReplica(t, source, replica_path)
+
+	current := pages.db.acquireSnapshot()
+	defer current.release()
+
+	if info, err := os.Stat(replica_path); err != nil || info.Size() != current.manifest.Size {
+		t.Errorf("replica wasn't truncated to the watched DB's %d bytes (%v)", current.manifest.Size, err)
+	}
+}
+
+func TestSyncPagesPageSizeMismatch(t *testing.T) {
+	pages, source, pages_url := newPagesServer(t, pagedSchema)
+
+	// a replica with a different page size can't be patched
+	replica_path, replica := createTestDB(t, "PRAGMA page_size = 1024; VACUUM; CREATE TABLE t(id INTEGER PRIMARY KEY, data BLOB);")
+	replica.Close()
+
+	if page_size, _ := readPageSize(replica_path); page_size != 1024 {
+		t.Fatalf("replica has a page size of %d", page_size)
+	}
+
+	if err := syncPages(http.DefaultClient, pages_url, replica_path, WatchConfig{NoBackup: true}); err != nil {
+		t.Fatal(err)
+	}
+	pages.checkReplica(t, source, replica_path)
+
+	current := pages.db.acquireSnapshot()
+	defer current.release()
+
+	if requested := len(pages.lastRequested()); requested != len(current.manifest.Hashes) {
+		t.Errorf("replica with another page size asked for %d of %d page ranges", requested, len(current.manifest.Hashes))
+	}
+}
+
+func TestSyncPagesSnapshotChanged(t *testing.T) {
+	pages, source, pages_url := newPagesServer(t, pagedSchema)
+	replica_path := filepath.Join(t.TempDir(), "replica.db")
+	options := WatchConfig{NoBackup: true}
+
+	if err := syncPages(http.DefaultClient, pages_url, replica_path, options); err != nil {
+		t.Fatal(err)
+	}
+	version, hash := readReplicaVersion(replica_path)
+
+	// the DB changes between the manifest and the pages being asked for
+	pages.change(t, source, "UPDATE t SET data = randomblob(300) WHERE id = 1;")
+	pages.before = func(r *http.Request) {
+		if r.Method == "POST" {
+			pages.before = nil
+			pages.change(t, source, "UPDATE t SET data = randomblob(300) WHERE id = 2;")
+		}
+	}
+
+	if err := syncPages(http.DefaultClient, pages_url, replica_path, options); err != errSnapshotChanged {
+		t.Fatalf("expected %q, got %v", errSnapshotChanged, err)
+	}
+
+	if new_version, new_hash := readReplicaVersion(replica_path); new_version != version || new_hash != hash {
+		t.Errorf("replica moved to version %d after a failed sync", new_version)
+	}
+
+	// the retry picks up the newest snapshot
+	if err := syncPages(http.DefaultClient, pages_url, replica_path, options); err != nil {
+		t.Fatal(err)
+	}
+	pages.checkReplica(t, source, replica_path)
+}
+
+func TestSyncPagesMissingRanges(t *testing.T) {
+	pages, _, pages_url := newPagesServer(t, pagedSchema)
+	replica_path := filepath.Join(t.TempDir(), "replica.db")
+
+	// upstream sends one range less than it was asked for
+	pages.before = func(r *http.Request) {
+		if r.Method == "POST" {
+			body, _ := ioutil.ReadAll(r.Body)
+			ranges := strings.Fields(string(body))
+			r.Body = ioutil.NopCloser(strings.NewReader(strings.Join(ranges[:len(ranges)-1], "\n")))
+		}
+	}
+
+	err := syncPages(http.DefaultClient, pages_url, replica_path, WatchConfig{NoBackup: true})
+	if err == nil || failureReason(err) != "verification" {
+		t.Fatalf("expected a verification failure, got %v", err)
+	}
+
+	if replica_exists, _ := exists(replica_path); replica_exists {
+		t.Error("replica was created from an incomplete set of page ranges")
+	}
+	if import_exists, _ := exists(importPath(replica_path)); import_exists {
+		t.Error("partial import was left behind")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// RedactionProfile masks sensitive columns in what's sent to syncers, so
+// replicas (say, for staging) can be fed from production. Hashed values are
+// keyed with Salt, which keeps them from being looked up by hashing guesses.
+type RedactionProfile struct {
+	Salt    string          `yaml:"salt,omitempty"`
+	Columns []RedactionRule `yaml:"columns"`
+}
+
+// RedactionRule is what's done to one column: "hash" replaces each value with
+// a hash of it (so equal values still match), "null" clears it and "fixed"
+// replaces it with Value. NULLs are left as they are.
+type RedactionRule struct {
+	Table  string `yaml:"table"`
+	Column string `yaml:"column"`
+	Action string `yaml:"action"`
+	Value  string `yaml:"value,omitempty"`
+}
+
+// redactTable holds the hash of each distinct value of a column while it's
+// being hashed
+const redactTable = "_watchdb_redact"
+
+func (p RedactionProfile) check() error {
+	for _, rule := range p.Columns {
+		if rule.Table == "" || rule.Column == "" {
+			return fmt.Errorf("every column needs a table and a column")
+		}
+
+		switch rule.Action {
+		case "hash", "null", "fixed":
+		default:
+			return fmt.Errorf("unknown action '%s' for %s.%s, use hash, null or fixed", rule.Action, rule.Table, rule.Column)
+		}
+	}
+
+	return nil
+}
+
+func (p RedactionProfile) hash(value string) string {
+	mac := hmac.New(sha256.New, []byte(p.Salt))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// apply redacts every column of the profile in source. Tables that aren't
+// there are skipped, since a profile may cover more than one DB (and a
+// filter may have dropped them), but a missing column is an error rather
+// than something left unredacted.
+func (p RedactionProfile) apply(source Database) error {
+	for _, rule := range p.Columns {
+		columns, err := source.Query(fmt.Sprintf("SELECT name FROM pragma_table_info(%s)", quoteLiteral(rule.Table)))
+		if err != nil {
+			return err
+		}
+
+		if len(columns) == 0 {
+			continue
+		}
+
+		found := false
+		for _, column := range columns {
+			if strings.EqualFold(asString(column[0]), rule.Column) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("table %s has no column %s", rule.Table, rule.Column)
+		}
+
+		table, column := quoteIdentifier(rule.Table), quoteIdentifier(rule.Column)
+
+		var script string
+		switch rule.Action {
+		case "null":
+			script = fmt.Sprintf("UPDATE %s SET %s = NULL;\n", table, column)
+		case "fixed":
+			script = fmt.Sprintf("UPDATE %s SET %s = %s WHERE %s IS NOT NULL;\n", table, column, quoteLiteral(rule.Value), column)
+		case "hash":
+			script, err = p.hashScript(source, table, column)
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := source.Exec(script); err != nil {
+			return fmt.Errorf("unable to redact %s.%s: %s", rule.Table, rule.Column, err)
+		}
+	}
+
+	return nil
+}
+
+// hashScript replaces every value of a column with its hash. Values are
+// hashed as SQL literals, so 1 and '1' hash differently.
+func (p RedactionProfile) hashScript(source Database, table string, column string) (string, error) {
+	values, err := source.Query(fmt.Sprintf("SELECT DISTINCT quote(%s) FROM %s WHERE %s IS NOT NULL", column, table, column))
+	if err != nil {
+		return "", err
+	}
+
+	var script strings.Builder
+	script.WriteString("BEGIN;\n")
+	fmt.Fprintf(&script, "CREATE TABLE %s(value TEXT PRIMARY KEY, hash TEXT);\n", redactTable)
+
+	for _, row := range values {
+		value := asString(row[0])
+		fmt.Fprintf(&script, "INSERT INTO %s VALUES(%s,%s);\n", redactTable, quoteLiteral(value), quoteLiteral(p.hash(value)))
+	}
+
+	fmt.Fprintf(&script, "UPDATE %s SET %s = (SELECT hash FROM %s WHERE value = quote(%s.%s)) WHERE %s IS NOT NULL;\n", table, column, redactTable, table, column, column)
+	fmt.Fprintf(&script, "DROP TABLE %s;\n", redactTable)
+	script.WriteString("COMMIT;\n")
+
+	return script.String(), nil
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Config is how to reach an S3-compatible object store (AWS, MinIO and the
+// like), for archives kept in a bucket. Anything left out is taken from the
+// usual AWS_ environment variables.
+type S3Config struct {
+	// defaults to AWS, at https://s3.<region>.amazonaws.com
+	Endpoint string `yaml:"endpoint,omitempty"`
+	Region   string `yaml:"region,omitempty"`
+
+	AccessKey    string `yaml:"access_key,omitempty"`
+	SecretKey    string `yaml:"secret_key,omitempty"`
+	SessionToken string `yaml:"session_token,omitempty"`
+}
+
+// objects are fetched one at a time, so larger chunks keep a snapshot to a
+// reasonable number of requests
+const s3ChunkSize = 1024 * 1024
+
+const s3Timeout = 60 * time.Second
+
+// s3Store keeps an archive under a prefix of a bucket, addressed by path
+// (endpoint/bucket/key) so it works the same against any S3-compatible store
+type s3Store struct {
+	client   *http.Client
+	endpoint *url.URL
+	bucket   string
+	prefix   string
+
+	region        string
+	access_key    string
+	secret_key    string
+	session_token string
+}
+
+func isS3Location(location string) bool {
+	return strings.HasPrefix(location, "s3://")
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+
+	return ""
+}
+
+// newS3Store opens the archive at location, an s3://bucket/prefix URL
+func newS3Store(location string, config S3Config) (*s3Store, error) {
+	bucket := strings.TrimPrefix(location, "s3://")
+	prefix := ""
+	if i := strings.Index(bucket, "/"); i >= 0 {
+		bucket, prefix = bucket[:i], strings.Trim(bucket[i+1:], "/")
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("no bucket in '%s', use s3://bucket/prefix", location)
+	}
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	s := &s3Store{
+		client: &http.Client{Timeout: s3Timeout},
+		bucket: bucket,
+		prefix: prefix,
+
+		region:        firstNonEmpty(config.Region, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1"),
+		access_key:    firstNonEmpty(config.AccessKey, os.Getenv("AWS_ACCESS_KEY_ID")),
+		secret_key:    firstNonEmpty(config.SecretKey, os.Getenv("AWS_SECRET_ACCESS_KEY")),
+		session_token: firstNonEmpty(config.SessionToken, os.Getenv("AWS_SESSION_TOKEN")),
+	}
+
+	if s.access_key == "" || s.secret_key == "" {
+		return nil, fmt.Errorf("no S3 credentials, set s3 access_key and secret_key in the config file or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+
+	endpoint := firstNonEmpty(config.Endpoint, os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL"), "https://s3."+s.region+".amazonaws.com")
+	endpoint_url, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil || endpoint_url.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint '%s'", endpoint)
+	}
+	s.endpoint = endpoint_url
+
+	return s, nil
+}
+
+func (s *s3Store) chunkSize() int {
+	return s3ChunkSize
+}
+
+// s3Escape escapes a path or query value the way signatures expect, which is
+// stricter than net/url
+func s3Escape(value string, keep_slash bool) string {
+	var escaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			escaped.WriteByte(c)
+		case c == '/' && keep_slash:
+			escaped.WriteByte(c)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+
+	return escaped.String()
+}
+
+// objectURL is where the object at key is, or the bucket itself with an
+// empty key
+func (s *s3Store) objectURL(key string, query url.Values) *url.URL {
+	object_path := s.endpoint.Path + "/" + s.bucket
+	if key != "" {
+		object_path += "/" + s.prefix + key
+	}
+
+	object_url := *s.endpoint
+	object_url.Path = object_path
+	object_url.RawPath = s3Escape(object_path, true)
+
+	// the query is sent exactly as it's signed
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var pairs []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			pairs = append(pairs, s3Escape(name, false)+"="+s3Escape(value, false))
+		}
+	}
+	object_url.RawQuery = strings.Join(pairs, "&")
+
+	return &object_url
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// sign adds an AWS Signature Version 4 to req, covering its host and every
+// header it's been given
+func (s *s3Store) sign(req *http.Request, payload_hash string, now time.Time) {
+	amz_date := now.UTC().Format("20060102T150405Z")
+	date := amz_date[:8]
+
+	req.Header.Set("X-Amz-Date", amz_date)
+	req.Header.Set("X-Amz-Content-Sha256", payload_hash)
+	if s.session_token != "" {
+		req.Header.Set("X-Amz-Security-Token", s.session_token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonical_headers strings.Builder
+	for _, name := range names {
+		canonical_headers.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signed_headers := strings.Join(names, ";")
+
+	canonical_request := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonical_headers.String(),
+		signed_headers,
+		payload_hash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	string_to_sign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amz_date,
+		scope,
+		sha256Hex([]byte(canonical_request)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secret_key), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, string_to_sign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.access_key, scope, signed_headers, signature))
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// do sends a signed request, returning the response only if it succeeded (and
+// os.ErrNotExist for anything that isn't there)
+func (s *s3Store) do(method string, key string, query url.Values, body []byte) (*http.Response, error) {
+	object_url := s.objectURL(key, query)
+
+	req, err := http.NewRequest(method, object_url.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// the URL is sent as it's signed, rather than however net/url would
+	// escape it
+	req.URL = object_url
+
+	if body != nil {
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+	}
+
+	s.sign(req, sha256Hex(body), time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 404 {
+		return nil, os.ErrNotExist
+	}
+
+	var s3_err s3Error
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if xml.Unmarshal(data, &s3_err) == nil && s3_err.Code != "" {
+		return nil, fmt.Errorf("S3 %s of %s failed: %s (%s)", method, object_url.Path, s3_err.Message, s3_err.Code)
+	}
+
+	return nil, fmt.Errorf("S3 %s of %s failed: %s", method, object_url.Path, resp.Status)
+}
+
+func (s *s3Store) put(key string, data []byte) error {
+	resp, err := s.do("PUT", key, nil, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+func (s *s3Store) get(key string) ([]byte, error) {
+	resp, err := s.do("GET", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (s *s3Store) modified(key string) (time.Time, error) {
+	resp, err := s.do("HEAD", key, nil, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	resp.Body.Close()
+
+	return http.ParseTime(resp.Header.Get("Last-Modified"))
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *s3Store) list(prefix string) ([]archiveObject, error) {
+	var objects []archiveObject
+
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.prefix + prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.do("GET", "", query, nil)
+		if err == os.ErrNotExist {
+			return nil, fmt.Errorf("bucket %s doesn't exist", s.bucket)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read S3 listing: %s", err)
+		}
+
+		for _, object := range result.Contents {
+			objects = append(objects, archiveObject{key: strings.TrimPrefix(object.Key, s.prefix), modified: object.LastModified})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *s3Store) remove(key string) error {
+	resp, err := s.do("DELETE", key, nil, nil)
+	if err == os.ErrNotExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
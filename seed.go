@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// A seed is a copy of a watched DB, as replicas see it, that's carried over
+// to a new replica some other way than the network (or just ahead of time),
+// so its first sync only has to fetch what changed since. It comes with the
+// same <file>.version a replica has, recording the upstream version it's at.
+
+// upstream couldn't be asked about the seed's version this time
+var errSeedUnchecked = errors.New("unable to check seed against upstream")
+
+// runSnapshot writes a seed of a watched DB to out_path, which is a SQL dump
+// if it ends in .sql and a copy of the DB otherwise
+func runSnapshot(arguments map[string]interface{}, options WatchConfig) {
+	if len(options.Databases) != 1 {
+		log.Fatal("give the one database to snapshot")
+	}
+	database := options.Databases[0]
+	out_path := arguments["<seed-file>"].(string)
+
+	if err := checkViews(options); err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	if path_exists, _ := exists(database.Path); !path_exists {
+		log.Fatalf("can't snapshot '%s', file not found", database.Path)
+	}
+
+	db := newWatchedDB(database.Name, database.Path)
+	db.filter = database.Filter
+	db.redaction = database.Redaction
+
+	version, manifest, err := writeSeed(db, out_path, options)
+	if err != nil {
+		log.Fatalf("unable to snapshot %s: %s", database.Path, err)
+	}
+
+	if version == 0 {
+		log.Warning("no version is recorded for %s, it isn't watched with this config directory. The seed can still be used, but syncers can't check it against the watcher's version.", database.Path)
+	}
+
+	fmt.Printf("wrote %s (version %d, %s)\n", out_path, version, formatSize(manifest.Size))
+	fmt.Printf("copy it along with %s to the replica, and start its syncer with --seed=%s\n", replicaVersionPath(out_path), out_path)
+}
+
+// writeSeed takes a consistent copy of db, applies the filter and redaction
+// profile replicas get by default, and writes it to out_path along with the
+// version the watcher last gave the DB
+func writeSeed(db *watchedDB, out_path string, options WatchConfig) (uint64, *pageManifest, error) {
+	name, err := snapshotName(db.path)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	copy_path := importPath(out_path)
+	_ = os.Remove(copy_path)
+	defer os.Remove(copy_path)
+
+	source, err := openDatabase(db.path)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	err = source.Backup(copy_path)
+	source.Close()
+	if err != nil {
+		return 0, nil, fmt.Errorf("unable to copy DB: %s", err)
+	}
+
+	page_size, err := readPageSize(copy_path)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	manifest, err := buildPageManifest(copy_path, page_size)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// if the DB has changed since the watcher last saw it, the seed is newer
+	// than the version it's given, which only means a little more is synced
+	// than needed
+	version, hash := loadVersion(name)
+	if hash != "" && hash != manifest.Id {
+		log.Info("%s has changed since the watcher's version %d, the seed is a little newer than that", db.path, version)
+	}
+
+	feed, err := hasChangeFeed(copy_path)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// like the snapshots the watcher serves, seeds don't get the change feed
+	view := db.viewFor(nil, options)
+	if !view.empty() || feed {
+		if err := applyView(copy_path, view); err != nil {
+			return 0, nil, err
+		}
+
+		if manifest, err = buildPageManifest(copy_path, page_size); err != nil {
+			return 0, nil, err
+		}
+		manifest.Redaction = view.Redaction
+	}
+
+	if strings.HasSuffix(out_path, ".sql") {
+		err = dumpSeed(copy_path, out_path)
+	} else {
+		err = copyFileContents(copy_path, out_path)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	writeReplicaVersion(out_path, version, manifest.Id, manifest.Redaction)
+
+	return version, manifest, nil
+}
+
+func dumpSeed(db_path string, out_path string) error {
+	source, err := openDatabase(db_path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	out, err := os.Create(out_path)
+	if err != nil {
+		return err
+	}
+
+	err = source.Dump(out)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// seedReplica installs a replica's seed, unless the replica is already at
+// least as new, once it's been checked against upstream. Whatever changed
+// since the seed was taken is synced as usual afterwards.
+func seedReplica(client *http.Client, pages_url string, database DatabaseConfig, options WatchConfig) error {
+	path := database.Path
+	seed := database.Seed
+
+	if seed_exists, _ := exists(seed); !seed_exists {
+		return fmt.Errorf("%s doesn't exist", seed)
+	}
+
+	version, hash := readReplicaVersion(seed)
+	redaction := readReplicaRedaction(seed)
+	if hash == "" {
+		return fmt.Errorf("%s is missing, or doesn't say what version the seed is at", replicaVersionPath(seed))
+	}
+
+	if local_version, _ := readReplicaVersion(path); local_version > 0 && local_version >= version {
+		log.Info("%s is already at version %d, not seeding it from %s (at version %d)", path, local_version, seed, version)
+		return nil
+	}
+
+	remote, err := fetchManifest(client, pages_url, options)
+	if err != nil && err != errPagesUnsupported {
+		log.Warning("unable to check seed %s against upstream: %s", seed, err)
+		return errSeedUnchecked
+	}
+
+	if remote != nil {
+		if version > remote.Version {
+			return fmt.Errorf("seed is at version %d, which is ahead of upstream's %d, so it must be from another watcher", version, remote.Version)
+		}
+
+		if redaction != remote.Redaction {
+			log.Warning("seed %s was redacted with '%s' but upstream sends '%s', most of it will be synced again", seed, redaction, remote.Redaction)
+		}
+	}
+
+	import_path := importPath(path)
+	_ = os.Remove(import_path)
+	defer os.Remove(import_path)
+
+	if page_size, err := readPageSize(seed); err == nil {
+		if err := copyFileContents(seed, import_path); err != nil {
+			return err
+		}
+
+		manifest, err := buildPageManifest(import_path, page_size)
+		if err != nil {
+			return err
+		}
+
+		if manifest.Id != hash {
+			return fmt.Errorf("%s doesn't match its version file, it may have been damaged while being copied", seed)
+		}
+	} else {
+		// anything that isn't a DB is taken to be a dump of one
+		in, err := os.Open(seed)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		db, err := openDatabase(import_path)
+		if err != nil {
+			return err
+		}
+
+		err = db.Restore(in)
+		db.Close()
+		if err != nil {
+			return fmt.Errorf("unable to import seed: %s", err)
+		}
+	}
+
+	if err := backupReplica(path, options); err != nil {
+		return err
+	}
+
+	if err := replaceReplica(import_path, path); err != nil {
+		return err
+	}
+
+	writeReplicaVersion(path, version, hash, redaction)
+
+	if remote != nil && remote.Id == hash {
+		log.Notice("seeded %s from %s, it's at upstream's current version %d", path, seed, version)
+	} else if remote != nil {
+		log.Notice("seeded %s from %s at version %d, catching up with upstream's version %d", path, seed, version, remote.Version)
+	} else {
+		log.Notice("seeded %s from %s at version %d", path, seed, version)
+	}
+
+	return nil
+}
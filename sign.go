@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Responses syncers build their DB from are signed in trailers, once the
+// whole body has been sent: its length, its SHA-256 digest, and signatures
+// over both (along with the version they're for). Signatures are an HMAC
+// keyed with the hash of the syncer's auth key (if it has one), and an
+// Ed25519 signature when the watcher has a signing key.
+const signatureTrailers = "X-Watchdb-Length, X-Watchdb-Digest, X-Watchdb-Signature"
+
+var errUnsigned = syncFailure("signature", "upstream didn't sign the response")
+var errDigestMismatch = syncFailure("verification", "digest mismatch on response from upstream")
+var errBadSignature = syncFailure("signature", "invalid signature on response from upstream")
+var errMissingSignature = syncFailure("signature", "upstream didn't sign the response with the syncer's auth key or its signing key")
+
+// set from --signing-key when watching, and --verify-key when syncing
+var signing_key ed25519.PrivateKey
+var verify_key ed25519.PublicKey
+
+// payloadDigest hashes a response body as it's written or read
+type payloadDigest struct {
+	h hash.Hash
+	n int64
+}
+
+func newPayloadDigest() *payloadDigest {
+	return &payloadDigest{h: sha256.New()}
+}
+
+func (d *payloadDigest) Write(p []byte) (int, error) {
+	d.h.Write(p)
+	d.n += int64(len(p))
+	return len(p), nil
+}
+
+func (d *payloadDigest) sum() string {
+	return hex.EncodeToString(d.h.Sum(nil))
+}
+
+// signedMessage is what's signed for a response, which ties the body to the
+// endpoint and the version and hash in its headers
+func signedMessage(endpoint string, version string, hash string, length int64, digest string) []byte {
+	return []byte(fmt.Sprintf("watchdb-v1\n%s\n%s\n%s\n%d\n%s\n", endpoint, version, hash, length, digest))
+}
+
+func hmacSignature(key []byte, message []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(message)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// startSignedResponse declares the signature trailers, and has to be called
+// before anything is written
+func startSignedResponse(w http.ResponseWriter) {
+	w.Header().Set("Trailer", signatureTrailers)
+}
+
+// finishSignedResponse signs a response once its body (which went through
+// digest) has been written
+func finishSignedResponse(w http.ResponseWriter, endpoint string, s *snapshot, digest *payloadDigest, client *Identity) {
+	sum := digest.sum()
+	message := signedMessage(endpoint, strconv.FormatUint(s.version, 10), s.Hash(), digest.n, sum)
+
+	var signatures []string
+	// identities that only use a certificate have no secret to sign with
+	if client != nil && client.SecretSHA256 != "" {
+		key, _ := hex.DecodeString(client.SecretSHA256)
+		signatures = append(signatures, "hmac-sha256="+hmacSignature(key, message))
+	}
+	if signing_key != nil {
+		signatures = append(signatures, "ed25519="+base64.StdEncoding.EncodeToString(ed25519.Sign(signing_key, message)))
+	}
+
+	w.Header().Set("X-Watchdb-Length", strconv.FormatInt(digest.n, 10))
+	w.Header().Set("X-Watchdb-Digest", sum)
+	if len(signatures) > 0 {
+		w.Header().Set("X-Watchdb-Signature", strings.Join(signatures, ", "))
+	}
+}
+
+// verifyPayload checks a response body that went through digest against the
+// trailers upstream sent with it, which are only there once the body has been
+// read to the end. Responses without trailers are only accepted from
+// watchers that don't sign them, and then only if no signature is required.
+func verifyPayload(resp *http.Response, endpoint string, digest *payloadDigest, options WatchConfig) error {
+	length := resp.Trailer.Get("X-Watchdb-Length")
+	expected_digest := resp.Trailer.Get("X-Watchdb-Digest")
+
+	if length == "" || expected_digest == "" {
+		// watchers that version their responses also sign them, so trailers
+		// missing from a versioned response were stripped along the way
+		if options.RequireSignature || verify_key != nil || resp.Header.Get("X-Watchdb-Version") != "" {
+			return errUnsigned
+		}
+		return nil
+	}
+
+	if length != strconv.FormatInt(digest.n, 10) {
+		return syncFailure("verification", "expected %s bytes from upstream, got %d", length, digest.n)
+	}
+
+	sum := digest.sum()
+	if expected_digest != sum {
+		return errDigestMismatch
+	}
+
+	signatures := make(map[string]string)
+	for _, signature := range strings.Split(resp.Trailer.Get("X-Watchdb-Signature"), ",") {
+		if i := strings.Index(signature, "="); i > 0 {
+			signatures[strings.TrimSpace(signature[:i])] = strings.TrimSpace(signature[i+1:])
+		}
+	}
+
+	message := signedMessage(endpoint, resp.Header.Get("X-Watchdb-Version"), resp.Header.Get("X-Watchdb-Hash"), digest.n, sum)
+	verified := false
+
+	// the watcher signs with the auth key of every syncer that sends one
+	if options.AuthKey != "" {
+		signature, ok := signatures["hmac-sha256"]
+		if !ok {
+			return errMissingSignature
+		}
+
+		key, _ := hex.DecodeString(hashSecret(options.AuthKey))
+		if !hmac.Equal([]byte(signature), []byte(hmacSignature(key, message))) {
+			return errBadSignature
+		}
+		verified = true
+	}
+
+	if verify_key != nil {
+		signature, err := base64.StdEncoding.DecodeString(signatures["ed25519"])
+		if err != nil || len(signature) == 0 {
+			return errMissingSignature
+		}
+		if !ed25519.Verify(verify_key, message, signature) {
+			return errBadSignature
+		}
+		verified = true
+	}
+
+	if options.RequireSignature && !verified {
+		return errUnsigned
+	}
+
+	return nil
+}
+
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s isn't a PEM file", path)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	private_key, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s isn't an Ed25519 private key", path)
+	}
+
+	return private_key, nil
+}
+
+func loadVerifyKey(path string) (ed25519.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s isn't a PEM file", path)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	public_key, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s isn't an Ed25519 public key", path)
+	}
+
+	return public_key, nil
+}
+
+// generateSigningKey writes a new Ed25519 key pair to path (for the watcher)
+// and path.pub (for syncers)
+func generateSigningKey(path string) error {
+	public_key, private_key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	private_der, err := x509.MarshalPKCS8PrivateKey(private_key)
+	if err != nil {
+		return err
+	}
+
+	public_der, err := x509.MarshalPKIXPublicKey(public_key)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: private_der}), 0600)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path+".pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public_der}), 0644)
+}
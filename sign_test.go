@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func generateTestKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	public_key, private_key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return public_key, private_key
+}
+
+// signedRoundTrip serves body with the signature for signed, and verifies
+// what the syncer gets back with options. Responses from older watchers have
+// no version, and strip takes out the "signature" trailer or all "trailers"
+// the way a proxy could.
+func signedRoundTrip(t *testing.T, client *Identity, sent string, signed string, version string, strip string, options WatchConfig) error {
+	current := &snapshot{version: 3, manifest: &pageManifest{Id: "abc123"}}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		startSignedResponse(w)
+		if version != "" {
+			w.Header().Set("X-Watchdb-Version", version)
+			w.Header().Set("X-Watchdb-Hash", current.Hash())
+		}
+
+		io.WriteString(w, sent)
+
+		if strip != "trailers" {
+			digest := newPayloadDigest()
+			io.WriteString(digest, signed)
+			finishSignedResponse(w, "latest", current, digest, client)
+		}
+		if strip == "signature" {
+			w.Header().Del("X-Watchdb-Signature")
+		}
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	digest := newPayloadDigest()
+	if _, err := io.Copy(digest, resp.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	return verifyPayload(resp, "latest", digest, options)
+}
+
+func TestVerifyPayload(t *testing.T) {
+	public_key, private_key := generateTestKey(t)
+	other_public_key, _ := generateTestKey(t)
+
+	syncer := &Identity{Name: "syncer", SecretSHA256: hashSecret("secret")}
+	body := "CREATE TABLE t(x);\n"
+
+	defer func() {
+		signing_key = nil
+		verify_key = nil
+	}()
+
+	for _, test := range []struct {
+		name    string
+		client  *Identity
+		signing ed25519.PrivateKey
+		verify  ed25519.PublicKey
+		options WatchConfig
+
+		// what's sent when it isn't what was signed
+		sent    string
+		version string
+		old     bool
+		strip   string
+
+		err    error
+		reason string
+	}{
+		{name: "auth key", client: syncer, options: WatchConfig{AuthKey: "secret", RequireSignature: true}},
+		{name: "signing key", signing: private_key, verify: public_key, options: WatchConfig{RequireSignature: true}},
+		{name: "auth and signing key", client: syncer, signing: private_key, verify: public_key, options: WatchConfig{AuthKey: "secret"}},
+		{name: "older watcher", old: true, strip: "trailers"},
+
+		{name: "older watcher with a signature required", old: true, strip: "trailers", options: WatchConfig{RequireSignature: true}, err: errUnsigned},
+		{name: "older watcher with verify key", old: true, strip: "trailers", verify: public_key, err: errUnsigned},
+		{name: "stripped trailers", strip: "trailers", err: errUnsigned},
+		{name: "stripped trailers with auth key", client: syncer, strip: "trailers", options: WatchConfig{AuthKey: "secret"}, err: errUnsigned},
+		{name: "stripped signature with auth key", client: syncer, strip: "signature", options: WatchConfig{AuthKey: "secret"}, err: errMissingSignature},
+		{name: "stripped signature with verify key", signing: private_key, verify: public_key, strip: "signature", err: errMissingSignature},
+		{name: "not signed with the auth key", options: WatchConfig{AuthKey: "secret"}, err: errMissingSignature},
+		{name: "no signature for the syncer", options: WatchConfig{RequireSignature: true}, err: errUnsigned},
+		{name: "tampered body", client: syncer, sent: "CREATE TABLE u(x);\n", options: WatchConfig{AuthKey: "secret"}, err: errDigestMismatch},
+		{name: "truncated body", client: syncer, sent: "CREATE TABLE", options: WatchConfig{AuthKey: "secret"}, reason: "verification"},
+		{name: "wrong auth key", client: syncer, options: WatchConfig{AuthKey: "other"}, err: errBadSignature},
+		{name: "wrong verify key", signing: private_key, verify: other_public_key, err: errBadSignature},
+		{name: "not signed with the signing key", client: syncer, verify: public_key, options: WatchConfig{AuthKey: "secret"}, err: errMissingSignature},
+		{name: "changed version with auth key", client: syncer, version: "4", options: WatchConfig{AuthKey: "secret"}, err: errBadSignature},
+		{name: "changed version with signing key", signing: private_key, verify: public_key, version: "4", err: errBadSignature},
+	} {
+		signing_key = test.signing
+		verify_key = test.verify
+
+		sent := body
+		if test.sent != "" {
+			sent = test.sent
+		}
+		version := "3"
+		if test.version != "" {
+			version = test.version
+		}
+		if test.old {
+			version = ""
+		}
+
+		err := signedRoundTrip(t, test.client, sent, body, version, test.strip, test.options)
+
+		switch {
+		case test.err != nil:
+			if err != test.err {
+				t.Errorf("%s: expected %q, got %v", test.name, test.err, err)
+			}
+		case test.reason != "":
+			if err == nil || failureReason(err) != test.reason {
+				t.Errorf("%s: expected a %s failure, got %v", test.name, test.reason, err)
+			}
+		case err != nil:
+			t.Errorf("%s: %s", test.name, err)
+		}
+	}
+}
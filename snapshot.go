@@ -0,0 +1,299 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// snapshot is a consistent copy of the watched DB, taken whenever it
+// changes. Every snapshot with new content gets the next version number, and
+// everything served to syncers comes from the current snapshot so that the
+// version and hash they're told always match what they receive.
+type snapshot struct {
+	db       *watchedDB
+	path     string
+	version  uint64
+	manifest *pageManifest
+
+	// whether it has the change feed in it, which only the watcher's own
+	// snapshot keeps
+	feed bool
+
+	refs    int
+	retired bool
+
+	// filtered or redacted copies of this snapshot, by view id. Each has this
+	// one as its parent, which keeps track of its refs.
+	parent *snapshot
+	views  map[string]*viewSnapshot
+}
+
+func (s *snapshot) Hash() string {
+	return s.manifest.Id
+}
+
+func (s *snapshot) ETag() string {
+	return fmt.Sprintf(`"%d-%s"`, s.version, s.manifest.Id)
+}
+
+// acquireSnapshot returns the current snapshot, which is kept on disk until
+// released even if a newer one replaces it in the meantime
+func (db *watchedDB) acquireSnapshot() *snapshot {
+	db.snapshot_lock.Lock()
+	defer db.snapshot_lock.Unlock()
+
+	if db.snapshot != nil {
+		db.snapshot.refs++
+	}
+
+	return db.snapshot
+}
+
+func (s *snapshot) release() {
+	if s.parent != nil {
+		s.parent.release()
+		return
+	}
+
+	s.db.snapshot_lock.Lock()
+	defer s.db.snapshot_lock.Unlock()
+
+	s.refs--
+	if s.retired && s.refs == 0 {
+		s.remove()
+	}
+}
+
+// remove deletes the snapshot along with its views, and must be called with
+// snapshot_lock held
+func (s *snapshot) remove() {
+	_ = os.Remove(s.path)
+
+	for _, view := range s.views {
+		if view.snapshot != nil {
+			_ = os.Remove(view.snapshot.path)
+		}
+	}
+}
+
+// dropSnapshot removes the current snapshot once nothing is using it, for
+// DBs that are no longer watched
+func (db *watchedDB) dropSnapshot() {
+	db.snapshot_lock.Lock()
+	defer db.snapshot_lock.Unlock()
+
+	if db.snapshot == nil {
+		return
+	}
+
+	db.snapshot.retired = true
+	if db.snapshot.refs == 0 {
+		db.snapshot.remove()
+	}
+	db.snapshot = nil
+
+	metricSnapshotSize.forget(db.name)
+}
+
+func snapshotDir() string {
+	snapshot_dir := path.Join(createWatchDBDir(), "snapshots")
+
+	err := os.MkdirAll(snapshot_dir, 0700)
+	if err != nil {
+		log.Fatalf("unable to create watchdb snapshot directory: %s", err)
+	}
+
+	return snapshot_dir
+}
+
+func snapshotName(db_path string) (string, error) {
+	abs_path, err := filepath.Abs(db_path)
+	if err != nil {
+		return "", err
+	}
+
+	name_sum := md5.Sum([]byte(abs_path))
+	return hex.EncodeToString(name_sum[:]), nil
+}
+
+// the last version handed out for a DB is kept on disk so versions keep
+// increasing across watcher restarts
+func loadVersion(name string) (uint64, string) {
+	data, err := ioutil.ReadFile(path.Join(snapshotDir(), name+".version"))
+	if err != nil {
+		return 0, ""
+	}
+
+	return parseVersion(string(data))
+}
+
+func saveVersion(name string, version uint64, hash string) error {
+	return ioutil.WriteFile(path.Join(snapshotDir(), name+".version"), []byte(fmt.Sprintf("%d %s\n", version, hash)), 0600)
+}
+
+// noHash stands in for the hash in a version record without one
+const noHash = "-"
+
+func parseVersion(data string) (uint64, string) {
+	fields := strings.Fields(data)
+	if len(fields) < 2 {
+		return 0, ""
+	}
+
+	version, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return 0, ""
+	}
+
+	if fields[1] == noHash {
+		return version, ""
+	}
+
+	return version, fields[1]
+}
+
+// refreshSnapshot takes a consistent copy of the DB (so it can be
+// served without racing writers) and hashes its page ranges. It reports
+// whether the content changed since the last snapshot.
+func (db *watchedDB) refreshSnapshot() (bool, error) {
+	name, err := snapshotName(db.path)
+	if err != nil {
+		return false, err
+	}
+
+	if db.snapshot_count == 0 {
+		// left behind by an earlier watcher that didn't get to clean up
+		stale, _ := filepath.Glob(path.Join(snapshotDir(), name+"-*.db"))
+		for _, stale_path := range stale {
+			_ = os.Remove(stale_path)
+		}
+	}
+
+	start := time.Now()
+
+	db.snapshot_count++
+	snapshot_path := path.Join(snapshotDir(), fmt.Sprintf("%s-%d.db", name, db.snapshot_count))
+
+	// backing up into an existing file would carry over its change counter,
+	// and with it change the hash
+	_ = os.Remove(snapshot_path)
+
+	// opening a missing DB would create an empty one in its place
+	if db_exists, _ := exists(db.path); !db_exists {
+		return false, fmt.Errorf("%s no longer exists", db.path)
+	}
+
+	source, err := openDatabase(db.path)
+	if err != nil {
+		return false, err
+	}
+
+	err = source.Backup(snapshot_path)
+	source.Close()
+	if err != nil {
+		_ = os.Remove(snapshot_path)
+		return false, fmt.Errorf("unable to snapshot DB: %s", err)
+	}
+
+	page_size, err := readPageSize(snapshot_path)
+	if err != nil {
+		_ = os.Remove(snapshot_path)
+		return false, err
+	}
+
+	manifest, err := buildPageManifest(snapshot_path, page_size)
+	if err != nil {
+		_ = os.Remove(snapshot_path)
+		return false, err
+	}
+
+	feed, err := hasChangeFeed(snapshot_path)
+	if err != nil {
+		_ = os.Remove(snapshot_path)
+		return false, err
+	}
+	metricSnapshotDuration.since(start, db.name)
+
+	db.snapshot_lock.Lock()
+	defer db.snapshot_lock.Unlock()
+
+	old := db.snapshot
+
+	var version uint64
+	var hash string
+	if old != nil {
+		version, hash = old.version, old.Hash()
+	} else {
+		version, hash = loadVersion(name)
+	}
+
+	if hash == manifest.Id && old != nil {
+		_ = os.Remove(snapshot_path)
+		return false, nil
+	}
+
+	if hash != manifest.Id {
+		version++
+		if err := saveVersion(name, version, manifest.Id); err != nil {
+			log.Warning("unable to save DB version: %s", err)
+		}
+	}
+
+	manifest.Version = version
+	db.snapshot = &snapshot{db: db, path: snapshot_path, version: version, manifest: manifest, feed: feed}
+	metricSnapshotSize.set(float64(manifest.Size), db.name)
+
+	if old != nil {
+		old.retired = true
+		if old.refs == 0 {
+			old.remove()
+		}
+	}
+
+	return true, nil
+}
+
+func setVersionHeaders(w http.ResponseWriter, s *snapshot) {
+	w.Header().Set("ETag", s.ETag())
+	w.Header().Set("X-Watchdb-Version", strconv.FormatUint(s.version, 10))
+	w.Header().Set("X-Watchdb-Hash", s.Hash())
+
+	if s.manifest.Redaction != "" {
+		w.Header().Set("X-Watchdb-Redaction", s.manifest.Redaction)
+	}
+}
+
+// notModified reports whether the client already has this snapshot, going by
+// If-None-Match or a since=<version> parameter
+func notModified(r *http.Request, s *snapshot) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		for _, etag := range strings.Split(match, ",") {
+			etag = strings.TrimSpace(etag)
+			if etag == s.ETag() || etag == "*" {
+				return true
+			}
+		}
+	}
+
+	if since := r.URL.Query().Get("since"); since != "" {
+		version, err := strconv.ParseUint(since, 10, 64)
+		if err == nil && version >= s.version {
+			return true
+		}
+	}
+
+	return false
+}
+
+func changeMessage(s *snapshot) string {
+	return fmt.Sprintf("modified %d %s\n", s.version, s.Hash())
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSnapshotVersions(t *testing.T) {
+	db, source := watchTestDB(t, "CREATE TABLE t(x);")
+
+	refresh := func(db *watchedDB, changed bool, version uint64) {
+		t.Helper()
+
+		got, err := db.refreshSnapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		current := db.acquireSnapshot()
+		defer current.release()
+
+		if got != changed || current.version != version {
+			t.Errorf("expected changed %t at version %d, got %t at version %d", changed, version, got, current.version)
+		}
+	}
+
+	refresh(db, true, 1)
+	refresh(db, false, 1)
+
+	if err := source.Exec("INSERT INTO t VALUES(1);"); err != nil {
+		t.Fatal(err)
+	}
+	refresh(db, true, 2)
+
+	// a restarted watcher carries on from the version it saved
+	db.dropSnapshot()
+	db = newWatchedDB("app", db.path)
+	t.Cleanup(db.dropSnapshot)
+	refresh(db, true, 2)
+
+	// and notices changes made while it wasn't watching
+	db.dropSnapshot()
+	if err := source.Exec("INSERT INTO t VALUES(2);"); err != nil {
+		t.Fatal(err)
+	}
+	db = newWatchedDB("app", db.path)
+	t.Cleanup(db.dropSnapshot)
+	refresh(db, true, 3)
+}
+
+func TestNotModified(t *testing.T) {
+	current := &snapshot{version: 5, manifest: &pageManifest{Id: "abc123"}}
+
+	for _, test := range []struct {
+		etag     string
+		since    string
+		expected bool
+	}{
+		{etag: `"5-abc123"`, expected: true},
+		{etag: `"4-def456", "5-abc123"`, expected: true},
+		{etag: "*", expected: true},
+		{etag: `"5-def456"`, expected: false},
+		{etag: `"4-abc123"`, expected: false},
+		{since: "5", expected: true},
+		{since: "6", expected: true},
+		{since: "4", expected: false},
+		{since: "latest", expected: false},
+		{expected: false},
+	} {
+		r := httptest.NewRequest("GET", "/latest", nil)
+		if test.etag != "" {
+			r.Header.Set("If-None-Match", test.etag)
+		}
+		if test.since != "" {
+			r.URL.RawQuery = "since=" + test.since
+		}
+
+		if got := notModified(r, current); got != test.expected {
+			t.Errorf("If-None-Match %s, since=%s: expected %t, got %t", test.etag, test.since, test.expected, got)
+		}
+	}
+}
+
+func TestConditionalDump(t *testing.T) {
+	db, _ := watchTestDB(t, "CREATE TABLE t(x); INSERT INTO t VALUES(1);")
+	if _, err := db.refreshSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	download_url := newDumpServer(t, db)
+
+	current := db.acquireSnapshot()
+	etag := current.ETag()
+	version, hash := current.version, current.Hash()
+	current.release()
+
+	req, _ := http.NewRequest("GET", download_url, nil)
+	req.Header.Set("If-None-Match", etag)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 304 || resp.Header.Get("ETag") != etag {
+		t.Errorf("expected a 304 with ETag %s, got %s with %s", etag, resp.Status, resp.Header.Get("ETag"))
+	}
+
+	// a replica that's already at the version isn't downloaded again
+	path, _ := createTestDB(t, "CREATE TABLE other(y);")
+	writeReplicaVersion(path, version, hash, "")
+
+	if err := syncDump(http.DefaultClient, download_url, path, WatchConfig{NoBackup: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	replica, err := openDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.Close()
+
+	if tables := queryValues(t, replica, "SELECT name FROM sqlite_master WHERE type = 'table'"); len(tables) != 1 || tables[0] != "other" {
+		t.Errorf("replica at the current version was replaced, now has %v", tables)
+	}
+
+	// one that isn't is
+	writeReplicaVersion(path, version-1, "old", "")
+	if err := syncDump(http.DefaultClient, download_url, path, WatchConfig{NoBackup: true}); err != nil {
+		t.Fatal(err)
+	}
+	if synced_version, synced_hash := readReplicaVersion(path); synced_version != version || synced_hash != hash {
+		t.Errorf("replica is at version %d (%s) after syncing", synced_version, synced_hash)
+	}
+}
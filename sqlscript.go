@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// sqlScanner splits a SQL script (such as a dump) into complete statements
+// without reading the whole script into memory. Like sqlite3_complete(), it
+// understands quoting, comments and the semicolons inside CREATE TRIGGER
+// bodies.
+type sqlScanner struct {
+	r         *bufio.Reader
+	statement string
+	err       error
+}
+
+func newSQLScanner(r io.Reader) *sqlScanner {
+	return &sqlScanner{r: bufio.NewReader(r)}
+}
+
+func (s *sqlScanner) Statement() string {
+	return s.statement
+}
+
+func (s *sqlScanner) Err() error {
+	return s.err
+}
+
+func (s *sqlScanner) Scan() bool {
+	var buf strings.Builder
+	var word strings.Builder
+	var words []string // leading keywords, to spot CREATE TRIGGER
+
+	// a trigger only ends at a ';' after END that directly follows a ';', so
+	// the END of a CASE expression doesn't end it. This is 1 after a ';' and
+	// 2 once END follows it.
+	trigger_end := 0
+
+	end_word := func() {
+		if word.Len() == 0 {
+			return
+		}
+		upper := strings.ToUpper(word.String())
+		if len(words) < 4 {
+			words = append(words, upper)
+		}
+		if trigger_end == 1 && upper == "END" {
+			trigger_end = 2
+		} else {
+			trigger_end = 0
+		}
+		word.Reset()
+	}
+
+	is_trigger := func() bool {
+		for i, w := range words {
+			if w == "TRIGGER" {
+				return i > 0 && words[0] == "CREATE"
+			}
+		}
+		return false
+	}
+
+	for {
+		c, _, err := s.r.ReadRune()
+		if err == io.EOF {
+			end_word()
+			s.statement = strings.TrimSpace(buf.String())
+			if s.statement != "" {
+				// an unterminated last statement is still worth running
+				return true
+			}
+			return false
+		}
+		if err != nil {
+			s.err = err
+			return false
+		}
+
+		switch {
+		case c == '\'' || c == '"' || c == '`' || c == '[':
+			end_word()
+			closing := c
+			if c == '[' {
+				closing = ']'
+			}
+
+			buf.WriteRune(c)
+			for {
+				q, _, err := s.r.ReadRune()
+				if err != nil {
+					if err != io.EOF {
+						s.err = err
+					}
+					s.statement = strings.TrimSpace(buf.String())
+					return s.err == nil && s.statement != ""
+				}
+				buf.WriteRune(q)
+				if q == closing {
+					// doubled quotes are escapes, keep going
+					if next, _, err := s.r.ReadRune(); err == nil {
+						if next == closing && closing != ']' {
+							buf.WriteRune(next)
+							continue
+						}
+						s.r.UnreadRune()
+					}
+					break
+				}
+			}
+			trigger_end = 0
+		case c == '-' && s.peek() == '-':
+			end_word()
+			line, _ := s.r.ReadString('\n')
+			buf.WriteRune(c)
+			buf.WriteString(line)
+		case c == '/' && s.peek() == '*':
+			end_word()
+			buf.WriteRune(c)
+			for {
+				r, _, err := s.r.ReadRune()
+				if err != nil {
+					break
+				}
+				buf.WriteRune(r)
+				if r == '*' && s.peek() == '/' {
+					s.r.ReadRune()
+					buf.WriteRune('/')
+					break
+				}
+			}
+		case c == ';':
+			end_word()
+			buf.WriteRune(c)
+
+			if is_trigger() && trigger_end != 2 {
+				trigger_end = 1
+				continue
+			}
+
+			s.statement = strings.TrimSpace(buf.String())
+			if s.statement == ";" {
+				buf.Reset()
+				words = words[:0]
+				continue
+			}
+			return true
+		case unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_':
+			word.WriteRune(c)
+			buf.WriteRune(c)
+		default:
+			end_word()
+			if !unicode.IsSpace(c) {
+				trigger_end = 0
+			}
+			buf.WriteRune(c)
+		}
+	}
+}
+
+func (s *sqlScanner) peek() rune {
+	c, _, err := s.r.ReadRune()
+	if err != nil {
+		return 0
+	}
+	s.r.UnreadRune()
+	return c
+}
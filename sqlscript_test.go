@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func scanStatements(t *testing.T, script string) []string {
+	scanner := newSQLScanner(strings.NewReader(script))
+
+	var statements []string
+	for scanner.Scan() {
+		statements = append(statements, scanner.Statement())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return statements
+}
+
+const caseTrigger = `CREATE TRIGGER size AFTER INSERT ON t BEGIN
+  UPDATE t SET y = CASE WHEN new.x > 1 THEN 'big' ELSE 'small' END;
+  SELECT 1;
+END;`
+
+func TestScanStatements(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		script     string
+		statements []string
+	}{
+		{"statements", "CREATE TABLE t(x);\nINSERT INTO t VALUES(1);", []string{"CREATE TABLE t(x);", "INSERT INTO t VALUES(1);"}},
+		{"quoted semicolons", "INSERT INTO t VALUES('a;b', \"c;\"\"d\");", []string{"INSERT INTO t VALUES('a;b', \"c;\"\"d\");"}},
+		{"comments", "-- a; b\nSELECT 1; /* c; */ SELECT 2;", []string{"-- a; b\nSELECT 1;", "/* c; */ SELECT 2;"}},
+		{"unterminated", "SELECT 1", []string{"SELECT 1"}},
+		{"trigger", "CREATE TRIGGER a AFTER INSERT ON t BEGIN SELECT 1; SELECT 2; END; SELECT 3;", []string{"CREATE TRIGGER a AFTER INSERT ON t BEGIN SELECT 1; SELECT 2; END;", "SELECT 3;"}},
+		{"CASE in a trigger", caseTrigger + "\nSELECT 2;", []string{caseTrigger, "SELECT 2;"}},
+		{"nested CASE in a trigger", "CREATE TRIGGER b AFTER UPDATE ON t BEGIN SELECT CASE WHEN 1 THEN CASE WHEN 2 THEN 'x' END END; END;", []string{"CREATE TRIGGER b AFTER UPDATE ON t BEGIN SELECT CASE WHEN 1 THEN CASE WHEN 2 THEN 'x' END END; END;"}},
+		{"comment before END", "CREATE TRIGGER c AFTER DELETE ON t BEGIN SELECT 1; -- done\nEND;", []string{"CREATE TRIGGER c AFTER DELETE ON t BEGIN SELECT 1; -- done\nEND;"}},
+		{"trigger in a transaction", "BEGIN TRANSACTION;\n" + caseTrigger + "\nCOMMIT;", []string{"BEGIN TRANSACTION;", caseTrigger, "COMMIT;"}},
+		{"END that isn't a trigger's", "BEGIN; SELECT 1; END;", []string{"BEGIN;", "SELECT 1;", "END;"}},
+	} {
+		statements := scanStatements(t, test.script)
+		if strings.Join(statements, "\n|\n") != strings.Join(test.statements, "\n|\n") {
+			t.Errorf("%s: split into %q", test.name, statements)
+		}
+	}
+}
+
+func TestExecTriggerWithCase(t *testing.T) {
+	_, db := createTestDB(t, "CREATE TABLE t(x, y);\n"+caseTrigger+"\nINSERT INTO t(x) VALUES(2);")
+
+	if sizes := queryValues(t, db, "SELECT DISTINCT y FROM t"); len(sizes) != 1 || sizes[0] != "big" {
+		t.Errorf("trigger set sizes %v", sizes)
+	}
+}
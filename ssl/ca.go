@@ -0,0 +1,236 @@
+package ssl
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// certificate roles, which decide what a certificate can be used for
+const (
+	RoleServer = "server"
+	RoleClient = "client"
+)
+
+// CA is a local certificate authority that issues watchers' server
+// certificates and syncers' client certificates. Its certificate is what
+// syncers verify watchers with (--ssl-ca) and watchers verify syncers with
+// (--ssl-client-ca).
+type CA struct {
+	Dir  string
+	Cert *x509.Certificate
+	key  crypto.Signer
+}
+
+func (ca *CA) CertPath() string {
+	return filepath.Join(ca.Dir, "ca.crt")
+}
+
+func (ca *CA) keyPath() string {
+	return filepath.Join(ca.Dir, "ca.key")
+}
+
+// IssuedPaths is where the certificate and key issued for name are kept
+func (ca *CA) IssuedPaths(name string) (string, string) {
+	return filepath.Join(ca.Dir, name+".crt"), filepath.Join(ca.Dir, name+".key")
+}
+
+// InitCA creates a CA in dir, refusing to replace one that's already there
+func InitCA(dir string, options CertOptions) (*CA, error) {
+	ca := &CA{Dir: dir}
+
+	for _, path := range []string{ca.CertPath(), ca.keyPath()} {
+		if _, err := os.Stat(path); err == nil {
+			return nil, fmt.Errorf("there's already a CA in %s", dir)
+		}
+	}
+
+	key, err := generateKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate private key: %s", err)
+	}
+
+	template, err := newTemplate(options)
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	template.MaxPathLenZero = true
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate: %s", err)
+	}
+
+	if err := writeKey(ca.keyPath(), key); err != nil {
+		return nil, err
+	}
+
+	if err := writeCertificate(ca.CertPath(), der); err != nil {
+		return nil, err
+	}
+
+	ca.Cert, _ = x509.ParseCertificate(der)
+	ca.key = key
+
+	return ca, nil
+}
+
+// LoadCA reads the CA in dir
+func LoadCA(dir string) (*CA, error) {
+	ca := &CA{Dir: dir}
+
+	cert, err := LoadCertificate(ca.CertPath())
+	if err != nil {
+		return nil, fmt.Errorf("no CA in %s (create one with watchdb ca init): %s", dir, err)
+	}
+
+	key, err := loadKey(ca.keyPath())
+	if err != nil {
+		return nil, err
+	}
+
+	ca.Cert = cert
+	ca.key = key
+
+	return ca, nil
+}
+
+func (ca *CA) sign(template *x509.Certificate, public_key crypto.PublicKey) ([]byte, error) {
+	// nothing the CA issues outlives it
+	if template.NotAfter.After(ca.Cert.NotAfter) {
+		template.NotAfter = ca.Cert.NotAfter
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, public_key, ca.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate: %s", err)
+	}
+
+	return der, nil
+}
+
+// Issue creates a key and a certificate for options.Name with the given role,
+// refusing to replace ones that were issued before (they're renewed instead)
+func (ca *CA) Issue(role string, options CertOptions) (*x509.Certificate, error) {
+	if strings.ContainsAny(options.Name, `/\`) || options.Name == "" || options.Name == "ca" {
+		return nil, fmt.Errorf("'%s' can't be used as a certificate name", options.Name)
+	}
+
+	cert_path, key_path := ca.IssuedPaths(options.Name)
+	for _, path := range []string{cert_path, key_path} {
+		if _, err := os.Stat(path); err == nil {
+			return nil, fmt.Errorf("%s already exists, use watchdb ca renew to renew it", path)
+		}
+	}
+
+	template, err := newTemplate(options)
+	if err != nil {
+		return nil, err
+	}
+
+	switch role {
+	case RoleServer:
+		if len(options.Hosts) == 0 {
+			return nil, errors.New("a server certificate needs the hosts it's for")
+		}
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	case RoleClient:
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	default:
+		return nil, fmt.Errorf("unknown role '%s', use server or client", role)
+	}
+
+	key, err := generateKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate private key: %s", err)
+	}
+
+	der, err := ca.sign(template, key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeKey(key_path, key); err != nil {
+		return nil, err
+	}
+
+	if err := writeCertificate(cert_path, der); err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(der)
+}
+
+// Renew reissues the certificate at cert_path for the same name, hosts, role
+// and key, so its pin stays the same and the key never has to be moved
+func (ca *CA) Renew(cert_path string, options CertOptions) (*x509.Certificate, error) {
+	old, err := LoadCertificate(cert_path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := old.CheckSignatureFrom(ca.Cert); err != nil {
+		return nil, fmt.Errorf("%s wasn't issued by this CA", cert_path)
+	}
+
+	options.Name = old.Subject.CommonName
+	options.Hosts = nil
+	if len(old.Subject.Organization) > 0 {
+		options.Organization = old.Subject.Organization[0]
+	}
+
+	template, err := newTemplate(options)
+	if err != nil {
+		return nil, err
+	}
+	template.DNSNames = old.DNSNames
+	template.IPAddresses = old.IPAddresses
+	template.ExtKeyUsage = old.ExtKeyUsage
+
+	der, err := ca.sign(template, old.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeCertificate(cert_path, der); err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(der)
+}
+
+// Issued lists the names of the certificates the CA has issued
+func (ca *CA) Issued() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(ca.Dir, "*.crt"))
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, path := range paths {
+		if path == ca.CertPath() {
+			continue
+		}
+		names = append(names, strings.TrimSuffix(filepath.Base(path), ".crt"))
+	}
+
+	return names, nil
+}
+
+// Role is what a certificate the CA issued is for
+func Role(cert *x509.Certificate) string {
+	for _, usage := range cert.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageServerAuth {
+			return RoleServer
+		}
+	}
+
+	return RoleClient
+}
@@ -7,115 +7,201 @@
 package ssl
 
 import (
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"fmt"
-	"log"
+	"io/ioutil"
 	"math/big"
 	"net"
 	"os"
-	"path"
-	"strings"
+	"path/filepath"
 	"time"
 )
 
-func publicKey(priv interface{}) interface{} {
-	switch k := priv.(type) {
-	case *rsa.PrivateKey:
-		return &k.PublicKey
-	case *ecdsa.PrivateKey:
-		return &k.PublicKey
-	default:
-		return nil
-	}
+// RenewBefore is how long before it expires a certificate is due for renewal
+const RenewBefore = 30 * 24 * time.Hour
+
+// CertOptions is what a certificate is issued for
+type CertOptions struct {
+	// common name, which is the identity of a client certificate
+	Name string
+
+	// hostnames and IP addresses a server certificate is valid for
+	Hosts []string
+
+	Organization string
+	ValidFor     time.Duration
 }
 
-func pemBlockForKey(priv interface{}) *pem.Block {
-	switch k := priv.(type) {
-	case *rsa.PrivateKey:
-		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
-	case *ecdsa.PrivateKey:
-		b, err := x509.MarshalECPrivateKey(k)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Unable to marshal ECDSA private key: %v", err)
-			os.Exit(2)
-		}
-		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}
-	default:
-		return nil
-	}
+func generateKey() (crypto.Signer, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 }
 
-func GenerateSelfSignedCerts() error {
-	host := "127.0.0.1"
-	validFor := 365 * 24 * time.Hour
-	rsaBits := 2048
+func serialNumber() (*big.Int, error) {
+	limit := new(big.Int).Lsh(big.NewInt(1), 128)
+	return rand.Int(rand.Reader, limit)
+}
 
-	var priv interface{}
-	var err error
-	priv, err = rsa.GenerateKey(rand.Reader, rsaBits)
+// newTemplate is the part of a certificate that doesn't depend on who issues
+// it
+func newTemplate(options CertOptions) (*x509.Certificate, error) {
+	serial, err := serialNumber()
 	if err != nil {
-		log.Fatal("failed to generate private key: %s", err)
+		return nil, fmt.Errorf("failed to generate serial number: %s", err)
 	}
 
-	notBefore := time.Now()
-	notAfter := notBefore.Add(validFor)
-
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
-	if err != nil {
-		log.Fatal("failed to generate serial number: %s", err)
-	}
+	// a little slack for clocks that are behind
+	not_before := time.Now().Add(-time.Hour)
 
-	template := x509.Certificate{
-		SerialNumber: serialNumber,
+	cert := &x509.Certificate{
+		SerialNumber: serial,
 		Subject: pkix.Name{
-			Organization: []string{"Acme Co"},
+			CommonName:   options.Name,
+			Organization: []string{options.Organization},
 		},
-		NotBefore: notBefore,
-		NotAfter:  notAfter,
+		NotBefore: not_before,
+		NotAfter:  not_before.Add(options.ValidFor),
 
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature,
 		BasicConstraintsValid: true,
 	}
 
-	hosts := strings.Split(host, ",")
-	for _, h := range hosts {
+	for _, h := range options.Hosts {
 		if ip := net.ParseIP(h); ip != nil {
-			template.IPAddresses = append(template.IPAddresses, ip)
+			cert.IPAddresses = append(cert.IPAddresses, ip)
 		} else {
-			template.DNSNames = append(template.DNSNames, h)
+			cert.DNSNames = append(cert.DNSNames, h)
 		}
 	}
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, publicKey(priv), priv)
+	return cert, nil
+}
+
+// GenerateSelfSignedCerts writes a self-signed server certificate for
+// options.Hosts to cert_path, and its key to key_path. Files that are already
+// there are only replaced if overwrite is set, and a key that's already there
+// is kept, so the certificate's pin doesn't change.
+func GenerateSelfSignedCerts(cert_path string, key_path string, options CertOptions, overwrite bool) (*x509.Certificate, error) {
+	if !overwrite {
+		for _, path := range []string{cert_path, key_path} {
+			if _, err := os.Stat(path); err == nil {
+				return nil, fmt.Errorf("%s already exists", path)
+			}
+		}
+	}
+
+	priv, err := loadKey(key_path)
 	if err != nil {
-		log.Fatal("Failed to create certificate: %s", err)
+		priv, err = generateKey()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate private key: %s", err)
+		}
+
+		if err := writeKey(key_path, priv); err != nil {
+			return nil, err
+		}
 	}
 
-	homedir := os.Getenv("HOME")
-	watchdb_dir := path.Join(homedir, ".config", "watchdb")
-	watchdb_cert_path := path.Join(watchdb_dir, "watchdb-cert.pem")
-	watchdb_key_path := path.Join(watchdb_dir, "watchdb-key.pem")
+	template, err := newTemplate(options)
+	if err != nil {
+		return nil, err
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
 
-	certOut, err := os.Create(watchdb_cert_path)
+	der, err := x509.CreateCertificate(rand.Reader, template, template, priv.Public(), priv)
 	if err != nil {
-		log.Fatalf("failed to open %s for writing: %s", watchdb_cert_path, err)
+		return nil, fmt.Errorf("failed to create certificate: %s", err)
+	}
+
+	if err := writeCertificate(cert_path, der); err != nil {
+		return nil, err
 	}
-	pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
-	certOut.Close()
 
-	keyOut, err := os.OpenFile(watchdb_key_path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	return x509.ParseCertificate(der)
+}
+
+func loadKey(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		log.Fatalf("failed to open %s for writing: %s", watchdb_key_path, err)
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s isn't a PEM file", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s isn't a signing key", path)
+	}
+
+	return signer, nil
+}
+
+func writeKey(path string, key crypto.Signer) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("unable to marshal private key: %s", err)
+	}
+
+	return writeFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+}
+
+func writeCertificate(path string, der []byte) error {
+	return writeFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// writeFile replaces path in one go, so a watcher reading it never sees half
+// of it
+func writeFile(path string, data []byte, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	tmp_path := path + ".tmp"
+	if err := ioutil.WriteFile(tmp_path, data, mode); err != nil {
+		return fmt.Errorf("failed to write %s: %s", path, err)
+	}
+
+	if err := os.Rename(tmp_path, path); err != nil {
+		_ = os.Remove(tmp_path)
+		return fmt.Errorf("failed to write %s: %s", path, err)
 	}
-	pem.Encode(keyOut, pemBlockForKey(priv))
-	keyOut.Close()
 
 	return nil
 }
+
+// Covers reports whether cert is valid for every one of hosts
+func Covers(cert *x509.Certificate, hosts []string) bool {
+	for _, h := range hosts {
+		if cert.VerifyHostname(h) != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ExpiresSoon reports whether cert expires within RenewBefore
+func ExpiresSoon(cert *x509.Certificate) bool {
+	return time.Until(cert.NotAfter) < RenewBefore
+}
@@ -0,0 +1,159 @@
+package ssl
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// LoadCertPool reads a bundle of PEM certificates, such as a CA
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+
+	return pool, nil
+}
+
+// LoadCertificate reads the first certificate in a PEM file
+func LoadCertificate(path string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// Pin is the SHA-256 hash of a certificate's public key, which stays the same
+// when a certificate is reissued for the same key
+func Pin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// ServerConfig is the TLS config for a watcher. With a client CA, syncers
+// have to present a certificate it issued.
+func ServerConfig(client_ca_file string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if client_ca_file != "" {
+		pool, err := LoadCertPool(client_ca_file)
+		if err != nil {
+			return nil, err
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// ClientOptions is how a syncer checks the watcher it connects to, and what
+// it identifies itself with
+type ClientOptions struct {
+	// verify the watcher's certificate against this CA bundle instead of the
+	// system's
+	CAFile string
+
+	// only accept a watcher whose certificate has this public key pin,
+	// whether or not its chain can be verified. Issuers can only be pinned
+	// along a chain that's verified against a CA.
+	Pin string
+
+	SkipVerify bool
+
+	CertFile string
+	KeyFile  string
+}
+
+// ClientConfig is the TLS config for a syncer
+func ClientConfig(options ClientOptions) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: options.SkipVerify,
+	}
+
+	if options.CAFile != "" {
+		pool, err := LoadCertPool(options.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	if options.CertFile != "" || options.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if options.Pin != "" {
+		pin := strings.ToLower(options.Pin)
+
+		// a pinned certificate is trusted on its own, which is what lets a
+		// self-signed one be used without skipping verification altogether
+		if options.CAFile == "" {
+			config.InsecureSkipVerify = true
+		}
+
+		config.VerifyPeerCertificate = checkPin(pin)
+	}
+
+	return config, nil
+}
+
+// checkPin accepts a verified chain with the pin anywhere along it, and
+// otherwise only a leaf certificate with the pin. The rest of a chain that
+// wasn't verified is whatever the server chose to send, so anyone could
+// append the pinned certificate to their own.
+func checkPin(pin string) func([][]byte, [][]*x509.Certificate) error {
+	return func(raw_certs [][]byte, verified_chains [][]*x509.Certificate) error {
+		for _, chain := range verified_chains {
+			for _, cert := range chain {
+				if Pin(cert) == pin {
+					return nil
+				}
+			}
+		}
+
+		if len(verified_chains) == 0 && len(raw_certs) > 0 {
+			leaf, err := x509.ParseCertificate(raw_certs[0])
+			if err == nil && Pin(leaf) == pin {
+				return nil
+			}
+		}
+
+		return errors.New("watcher's certificate doesn't match the pinned key")
+	}
+}
+
+// PeerName is the name a verified client certificate was issued to, or ""
+// if there's no verified client certificate
+func PeerName(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
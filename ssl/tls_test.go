@@ -0,0 +1,113 @@
+package ssl
+
+import (
+	"crypto/tls"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func selfSigned(t *testing.T, dir string, name string) (tls.Certificate, string) {
+	cert_path, key_path := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+
+	cert, err := GenerateSelfSignedCerts(cert_path, key_path, CertOptions{Hosts: []string{"127.0.0.1"}, ValidFor: 24 * time.Hour}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pair, err := tls.LoadX509KeyPair(cert_path, key_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pair, Pin(cert)
+}
+
+// handshake connects to a server presenting chain, and returns the client's
+// error
+func handshake(t *testing.T, chain tls.Certificate, options ClientOptions) error {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{chain}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		conn.(*tls.Conn).Handshake()
+		conn.Close()
+	}()
+
+	config, err := ClientConfig(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), config)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+
+	return nil
+}
+
+func TestPinnedLeaf(t *testing.T) {
+	dir := t.TempDir()
+	watcher, pin := selfSigned(t, dir, "watcher")
+	other, _ := selfSigned(t, dir, "other")
+
+	if err := handshake(t, watcher, ClientOptions{Pin: pin}); err != nil {
+		t.Errorf("pinned certificate rejected: %s", err)
+	}
+
+	if err := handshake(t, other, ClientOptions{Pin: pin}); err == nil {
+		t.Error("certificate that isn't pinned accepted")
+	}
+}
+
+func TestPinnedCertificateAppendedToChain(t *testing.T) {
+	dir := t.TempDir()
+	watcher, pin := selfSigned(t, dir, "watcher")
+	attacker, _ := selfSigned(t, dir, "attacker")
+
+	// the watcher's certificate is public, so anyone can send it along with
+	// their own
+	attacker.Certificate = append(attacker.Certificate, watcher.Certificate[0])
+
+	if err := handshake(t, attacker, ClientOptions{Pin: pin}); err == nil {
+		t.Error("pinned certificate accepted when it isn't the leaf of an unverified chain")
+	}
+}
+
+func TestPinnedIssuer(t *testing.T) {
+	dir := t.TempDir()
+
+	ca, err := InitCA(dir, CertOptions{Name: "test CA", ValidFor: 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ca.Issue(RoleServer, CertOptions{Name: "watcher", Hosts: []string{"127.0.0.1"}, ValidFor: 24 * time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+
+	cert_path, key_path := ca.IssuedPaths("watcher")
+	watcher, err := tls.LoadX509KeyPair(cert_path, key_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher.Certificate = append(watcher.Certificate, ca.Cert.Raw)
+
+	ca_pin := Pin(ca.Cert)
+
+	if err := handshake(t, watcher, ClientOptions{CAFile: ca.CertPath(), Pin: ca_pin}); err != nil {
+		t.Errorf("verified chain with pinned issuer rejected: %s", err)
+	}
+
+	if err := handshake(t, watcher, ClientOptions{Pin: ca_pin}); err == nil {
+		t.Error("pinned issuer accepted on a chain that wasn't verified")
+	}
+}
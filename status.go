@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how far behind upstream a replica can fall before it's reported unhealthy,
+// unless set otherwise
+const defaultMaxLag = 60
+
+// replicaStatus is what a syncer knows about how current one replica is
+type replicaStatus struct {
+	mu sync.Mutex
+
+	name string
+	path string
+
+	connected    bool
+	state_change time.Time
+
+	// newest version upstream has announced
+	upstream_version uint64
+
+	// since when the replica has been behind upstream (or couldn't tell,
+	// because it wasn't connected), zero while it's current
+	behind_since time.Time
+
+	last_sync    time.Time
+	last_error   string
+	failures     int
+	backup_error string
+}
+
+// statusRegistry is the set of replicas a syncer keeps, by path
+type statusRegistry struct {
+	mu       sync.Mutex
+	started  time.Time
+	replicas map[string]*replicaStatus
+}
+
+var replicas = &statusRegistry{started: time.Now(), replicas: make(map[string]*replicaStatus)}
+
+func (r *statusRegistry) add(name string, path string) *replicaStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := &replicaStatus{name: name, path: path, state_change: time.Now(), behind_since: time.Now()}
+	r.replicas[path] = status
+
+	return status
+}
+
+func (r *statusRegistry) remove(path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.replicas, path)
+}
+
+// get returns the status of the replica at path, or nil if it isn't synced
+func (r *statusRegistry) get(path string) *replicaStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.replicas[path]
+}
+
+func (r *statusRegistry) list() []*replicaStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := make([]*replicaStatus, 0, len(r.replicas))
+	for _, status := range r.replicas {
+		list = append(list, status)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].path < list[j].path
+	})
+
+	return list
+}
+
+func (s *replicaStatus) setConnected(connected bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.connected == connected {
+		return
+	}
+
+	s.connected = connected
+	s.state_change = time.Now()
+
+	if !connected && s.behind_since.IsZero() {
+		s.behind_since = time.Now()
+	}
+}
+
+// announced records a version upstream says it's at
+func (s *replicaStatus) announced(version uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if version > s.upstream_version {
+		s.upstream_version = version
+	}
+
+	if applied, _ := readReplicaVersion(s.path); version > applied && s.behind_since.IsZero() {
+		s.behind_since = time.Now()
+	}
+}
+
+// synced records a sync that brought the replica up to date with upstream
+func (s *replicaStatus) synced() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.last_sync = time.Now()
+	s.last_error = ""
+	s.failures = 0
+	s.backup_error = ""
+	metricSyncs.inc(s.path)
+
+	applied, _ := readReplicaVersion(s.path)
+	if applied > s.upstream_version {
+		s.upstream_version = applied
+	}
+
+	if s.connected && applied >= s.upstream_version {
+		s.behind_since = time.Time{}
+	}
+}
+
+func (s *replicaStatus) failed(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.last_error = err.Error()
+	s.failures++
+	metricSyncFailures.inc(s.path, failureReason(err))
+}
+
+func (s *replicaStatus) backupFailed(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.backup_error = err.Error()
+}
+
+// replicaState is what's current about a replica, for metrics
+type replicaState struct {
+	connected        bool
+	version          uint64
+	upstream_version uint64
+	lag              time.Duration
+}
+
+func (s *replicaStatus) state() replicaState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := replicaState{connected: s.connected, upstream_version: s.upstream_version}
+	state.version, _ = readReplicaVersion(s.path)
+	if !s.behind_since.IsZero() {
+		state.lag = time.Since(s.behind_since)
+	}
+
+	return state
+}
+
+type backupReport struct {
+	Enabled   bool       `json:"enabled"`
+	Count     int        `json:"count"`
+	Newest    *time.Time `json:"newest,omitempty"`
+	Size      int64      `json:"size"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+type replicaReport struct {
+	Name    string `json:"name,omitempty"`
+	Path    string `json:"path"`
+	Healthy bool   `json:"healthy"`
+	Problem string `json:"problem,omitempty"`
+
+	Connected bool      `json:"connected"`
+	Since     time.Time `json:"since"`
+
+	Version         uint64  `json:"version"`
+	UpstreamVersion uint64  `json:"upstream_version"`
+	VersionsBehind  uint64  `json:"versions_behind"`
+	LagSeconds      float64 `json:"lag_seconds"`
+
+	LastSync   *time.Time `json:"last_sync,omitempty"`
+	LastImport *time.Time `json:"last_import,omitempty"`
+
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	LastError           string `json:"last_error,omitempty"`
+
+	Backups backupReport `json:"backups"`
+}
+
+// report describes the replica, which is unhealthy once it's been behind
+// upstream for longer than max_lag
+func (s *replicaStatus) report(options WatchConfig, max_lag time.Duration) replicaReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	version, _ := readReplicaVersion(s.path)
+
+	report := replicaReport{
+		Name:                s.name,
+		Path:                s.path,
+		Connected:           s.connected,
+		Since:               s.state_change,
+		Version:             version,
+		UpstreamVersion:     s.upstream_version,
+		ConsecutiveFailures: s.failures,
+		LastError:           s.last_error,
+	}
+
+	if s.upstream_version > version {
+		report.VersionsBehind = s.upstream_version - version
+	}
+
+	if !s.behind_since.IsZero() {
+		report.LagSeconds = now.Sub(s.behind_since).Seconds()
+	}
+
+	if !s.last_sync.IsZero() {
+		last_sync := s.last_sync
+		report.LastSync = &last_sync
+	}
+
+	if info, err := os.Stat(s.path); err == nil {
+		last_import := info.ModTime()
+		report.LastImport = &last_import
+	}
+
+	report.Backups.Enabled = !options.NoBackup
+	report.Backups.LastError = s.backup_error
+	if backups, err := listBackups(s.path, options.Backups); err != nil {
+		report.Backups.LastError = err.Error()
+	} else {
+		report.Backups.Count = len(backups)
+		for _, backup := range backups {
+			report.Backups.Size += backup.size
+		}
+		if len(backups) > 0 {
+			report.Backups.Newest = &backups[0].time
+		}
+	}
+
+	switch {
+	case report.LastImport == nil || version == 0:
+		report.Problem = "no copy synced from upstream yet"
+	case report.LagSeconds > max_lag.Seconds() && !s.connected:
+		report.Problem = fmt.Sprintf("disconnected from upstream for %ds", int(now.Sub(s.state_change).Seconds()))
+	case report.LagSeconds > max_lag.Seconds():
+		report.Problem = fmt.Sprintf("%d versions behind upstream for %ds", report.VersionsBehind, int(report.LagSeconds))
+	default:
+		report.Healthy = true
+	}
+
+	return report
+}
+
+// serveStatus serves how current a syncer's replicas are: /status has the
+// details, and /health is 200 while every replica (or the one asked for with
+// ?db=) is healthy and 503 otherwise, for load balancers to check. The
+// syncer's /metrics are served alongside.
+func serveStatus(addr string, options WatchConfig) {
+	max_lag := time.Duration(options.MaxLag) * time.Second
+
+	reports := func(r *http.Request) []replicaReport {
+		db := r.URL.Query().Get("db")
+
+		var list []replicaReport
+		for _, status := range replicas.list() {
+			if db == "" || db == status.name || db == status.path {
+				list = append(list, status.report(options, max_lag))
+			}
+		}
+
+		return list
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		list := reports(r)
+
+		healthy := len(list) > 0
+		for _, report := range list {
+			healthy = healthy && report.Healthy
+		}
+
+		data, err := json.MarshalIndent(map[string]interface{}{
+			"healthy":  healthy,
+			"started":  replicas.started,
+			"upstream": options.RemoteConn,
+			"replicas": list,
+		}, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(append(data, '\n'))
+	})
+
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		list := reports(r)
+
+		var problems []string
+		for _, report := range list {
+			if !report.Healthy {
+				problems = append(problems, fmt.Sprintf("%s: %s", report.Path, report.Problem))
+			}
+		}
+		if len(list) == 0 {
+			problems = append(problems, "no replicas being synced")
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		if len(problems) > 0 {
+			w.WriteHeader(503)
+			fmt.Fprintf(w, "%s\n", strings.Join(problems, "\n"))
+			return
+		}
+
+		fmt.Fprintf(w, "ok\n")
+	})
+
+	mux.HandleFunc("/metrics", serveMetrics)
+
+	log.Notice("serving replica status at http://%s/status", addr)
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+const walHeaderSize = 32
+const walFrameHeaderSize = 24
+
+// walState tracks how far into a -wal file committed transactions reach.
+// Frames past the last commit frame belong to a transaction still in
+// progress (or a rolled back one) and are ignored.
+type walState struct {
+	salt      []byte
+	page_size int64
+	scanned   int64 // offset of the next frame to examine
+	committed int64 // offset just past the last commit frame
+	commits   int64
+}
+
+func isWALMode(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	header := make([]byte, 20)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return false
+	}
+
+	// file format write/read versions are both 2 in WAL mode
+	return header[18] == 2 && header[19] == 2
+}
+
+// update scans frames appended since the last call and reports whether a new
+// transaction was committed. A checkpoint restarting the log (new salt) or a
+// truncated log resets the scan.
+func (s *walState) update(wal_path string) (bool, error) {
+	file, err := os.Open(wal_path)
+	if os.IsNotExist(err) {
+		changed := s.committed > 0
+		*s = walState{}
+		return changed, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	header := make([]byte, walHeaderSize)
+	if _, err := io.ReadFull(file, header); err != nil {
+		// empty or partially written log, nothing committed yet
+		changed := s.committed > 0
+		*s = walState{}
+		return changed, nil
+	}
+
+	magic := binary.BigEndian.Uint32(header[0:4])
+	if magic != 0x377f0682 && magic != 0x377f0683 {
+		return false, fmt.Errorf("%s is not a sqlite WAL file", wal_path)
+	}
+
+	changed := false
+	if !bytes.Equal(s.salt, header[16:24]) {
+		changed = s.committed > 0
+		*s = walState{
+			salt:      append([]byte{}, header[16:24]...),
+			page_size: int64(binary.BigEndian.Uint32(header[8:12])),
+			scanned:   walHeaderSize,
+			committed: walHeaderSize,
+		}
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	if info.Size() < s.scanned {
+		s.scanned = s.committed
+	}
+
+	frame_size := walFrameHeaderSize + s.page_size
+	frame_header := make([]byte, walFrameHeaderSize)
+
+	for s.scanned+frame_size <= info.Size() {
+		if _, err := file.ReadAt(frame_header, s.scanned); err != nil {
+			return false, err
+		}
+
+		// frames left over from before the last log restart carry an old salt
+		if !bytes.Equal(frame_header[8:16], s.salt) {
+			break
+		}
+
+		s.scanned += frame_size
+
+		if binary.BigEndian.Uint32(frame_header[4:8]) != 0 {
+			s.committed = s.scanned
+			s.commits++
+			changed = true
+		}
+	}
+
+	return changed, nil
+}
+
+func (s *walState) fingerprint() string {
+	return fmt.Sprintf("%x:%d", s.salt, s.committed)
+}
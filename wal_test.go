@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestWALCommits(t *testing.T) {
+	// the test's connection stays open, so the log is only checkpointed
+	// when asked
+	path, db := createTestDB(t, "PRAGMA journal_mode = WAL; PRAGMA wal_autocheckpoint = 0; PRAGMA cache_size = 2; CREATE TABLE t(x);")
+	wal_path := path + "-wal"
+
+	if !isWALMode(path) {
+		t.Fatal("DB isn't in WAL mode")
+	}
+
+	state := &walState{}
+	update := func() bool {
+		changed, err := state.update(wal_path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return changed
+	}
+
+	if !update() || state.commits != 1 {
+		t.Fatalf("expected the CREATE TABLE to be committed, got %d commits", state.commits)
+	}
+	if update() {
+		t.Error("unchanged log reported as committed to")
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := db.Exec("INSERT INTO t VALUES(randomblob(100));"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !update() || state.commits != 4 {
+		t.Errorf("expected 4 commits, got %d", state.commits)
+	}
+
+	// a transaction too large for the cache spills frames into the log
+	// before it's committed
+	if err := db.Exec("BEGIN; INSERT INTO t SELECT randomblob(2000) FROM t, t AS a, t AS b;"); err != nil {
+		t.Fatal(err)
+	}
+	if update() {
+		t.Error("frames of a transaction in progress counted as a commit")
+	}
+	if err := db.Exec("COMMIT;"); err != nil {
+		t.Fatal(err)
+	}
+	if !update() || state.commits != 5 {
+		t.Errorf("expected the transaction to be counted once it was committed, got %d commits", state.commits)
+	}
+
+	// a checkpoint that truncates the log starts the count over
+	if err := db.Exec("PRAGMA wal_checkpoint(TRUNCATE);"); err != nil {
+		t.Fatal(err)
+	}
+	update()
+	if state.commits != 0 {
+		t.Errorf("truncated log still has %d commits", state.commits)
+	}
+
+	if err := db.Exec("INSERT INTO t VALUES(1);"); err != nil {
+		t.Fatal(err)
+	}
+	if !update() || state.commits != 1 {
+		t.Errorf("expected a commit to the restarted log, got %d", state.commits)
+	}
+}
@@ -1,40 +1,47 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
-	"compress/gzip"
-	"container/list"
 	"crypto/md5"
-	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
 	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/dkulchenko/watchdb/ssl"
 	"github.com/docopt/docopt-go"
-	"github.com/howeyc/fsnotify"
 	"github.com/op/go-logging"
 )
 
 var log = logging.MustGetLogger("watchdb")
 
-var clients = make(chan chan string, 1)
-var channels = list.New()
-
 var sqlite_path string
 
 func main() {
 	usage := `watchdb
 
 Usage:
-  watchdb watch [options] <db.sql>
-  watchdb sync [options] <remote> <db.sql>
+  watchdb watch [options] [<db.sql>...]
+  watchdb sync [options] <remote> [<db.sql>...]
+  watchdb keyring new <name>
+  watchdb keyring hash
+  watchdb signing-key new <key-file>
+  watchdb encryption-key new <key-file>
+  watchdb backups list [options] [<db.sql>...]
+  watchdb backups restore [options] <db.sql> <generation>
+  watchdb restore [options] --at=<time> <db.sql>
+  watchdb snapshot [options] <db.sql> <seed-file>
+  watchdb ca init [options]
+  watchdb ca issue [options] --role=<role> <cert-name>
+  watchdb ca renew [options] [<cert-name>...]
 
 Options:
   -h --help               Show this screen
@@ -43,12 +50,38 @@ Options:
   -a --bind-addr=<addr>   Address to bind to (default 0.0.0.0)
   -p --bind-port=<port>   Port to bind to (default 8144)
   -i --sync-interval=<ms> Notify slaves at most every X milliseconds (default 1000)
-  --no-backup             Don't create a backup file prior to sync
+  --no-backup             Don't back up the local DB before syncing over it
+  --archive               Archive every version watched or synced (see watchdb restore, and --bootstrap-from)
+  --archive-to=<location> Archive to a directory or S3 bucket (s3://bucket/prefix), instead of <db>.archive
+  --bootstrap-from=<location>  Restore the local DB from a watcher's archive while the watcher can't be reached
+  --s3-endpoint=<url>     S3-compatible endpoint to archive to (default AWS)
+  --seed=<file>           Start a new local DB from a seed made with watchdb snapshot, only syncing what's changed since
+  --status-addr=<addr>    Serve the local DBs' status, health and metrics over http at this address (like 127.0.0.1:8145)
+  --max-lag=<seconds>     How long a local DB can be behind upstream before it's unhealthy (default 60)
+  --at=<time>             When to restore the local DB as of, like "2026-10-01 12:00"
+  --out=<file>            Restore to another file, instead of over the local DB
   -s --ssl                Use https for connecting to watcher (recommended)
   --ssl-key-file=<file>   SSL private key file to use for encrypted connections (will be generated if not provided)
   --ssl-cert-file=<file>  SSL certificate file to use for encrypted connections (will be generated if not provided)
-  --ssl-skip-verify       Don't verify SSL certificate (required if self-signed or auto-generated)
+  --ssl-skip-verify       Don't verify SSL certificate (required if self-signed or auto-generated, unless pinned)
+  --ssl-client-ca=<file>  CA bundle syncers' client certificates have to be issued by (requires them)
+  --ssl-client-cert=<file>  Client certificate to present to the watcher
+  --ssl-client-key=<file>   Private key of the client certificate
+  --ssl-ca=<file>         CA bundle to verify the watcher's certificate with, instead of the system's
+  --ssl-pin=<sha256>      Only trust a watcher whose certificate has this public key hash
+  --host=<hosts>          Hostnames and IPs (comma-separated) the watcher's certificate is for (default: bind address, hostname, localhost)
+  --valid-days=<days>     How long generated and issued certificates are valid for (default 365, ten times that for a CA)
+  --ca-dir=<dir>          Where the CA for watchdb ca is kept (default ~/.config/watchdb/ca)
+  --role=<role>           What an issued certificate is for: server (a watcher) or client (a syncer)
   --auth-key=<auth-key>   Auth key to be sent (or required) with all connections
+  --signing-key=<file>    Ed25519 private key to sign responses with when watching
+  --verify-key=<file>     Ed25519 public key responses must be signed with when syncing
+  --require-signature     Refuse responses that aren't signed with the auth key or verify key
+  --decrypt-key=<file>    X25519 private key to decrypt responses with when syncing (requires them to be encrypted)
+  --sqlite-binary=<file>  Use an external sqlite3 binary instead of the built-in driver ("auto" to find one)
+  -d --dir=<dir>          Watch every database under a directory (or mirror them all into one when syncing)
+  --change-feed           Record row-level changes and serve them at /changes (installs triggers in watched databases)
+  --change-retention=<n>  Number of recent changes to keep in the change feed (default 10000)
 `
 
 	arguments, err := docopt.Parse(usage, nil, true, "0.1", false)
@@ -66,34 +99,156 @@ Options:
 	logformatter := logging.NewBackendFormatter(logbackend, format)
 	logging.SetBackend(logformatter)
 
-	sqlite_path = determineSqlitePath()
+	if arguments["keyring"].(bool) {
+		runKeyring(arguments)
+		return
+	}
+
+	if arguments["signing-key"].(bool) {
+		key_file := arguments["<key-file>"].(string)
+		if err := generateSigningKey(key_file); err != nil {
+			log.Fatalf("unable to generate signing key: %s", err)
+		}
+
+		fmt.Printf("wrote private key to %s (for the watcher's --signing-key) and public key to %s.pub (for syncers' --verify-key)\n", key_file, key_file)
+		return
+	}
+
+	if arguments["encryption-key"].(bool) {
+		key_file := arguments["<key-file>"].(string)
+		recipient, err := generateDecryptKey(key_file)
+		if err != nil {
+			log.Fatalf("unable to generate encryption key: %s", err)
+		}
+
+		fmt.Printf("wrote private key to %s (for the syncer's --decrypt-key)\n\n", key_file)
+		fmt.Printf("add its recipient key to the replica's keyring entry in the watcher's config file:\n\n")
+		fmt.Printf("    recipient: %s\n", recipient)
+		return
+	}
+
 	options := loadConfig(arguments)
 
+	if arguments["ca"].(bool) {
+		runCA(arguments, options)
+		return
+	}
+
+	if arguments["backups"].(bool) {
+		runBackups(arguments, options)
+		return
+	}
+
+	setupSqlite(options)
+
+	if arguments["restore"].(bool) {
+		runRestore(arguments, options)
+		return
+	}
+
+	if arguments["snapshot"].(bool) {
+		runSnapshot(arguments, options)
+		return
+	}
+
+	warnExpiringCerts(options, arguments["watch"].(bool))
+
 	log.Info("starting watchdb")
 
 	if arguments["watch"].(bool) {
-		path := options.SyncFile
-		path_exists, err := exists(path)
+		if len(options.Databases) == 0 && options.Dir == "" {
+			log.Error("nothing to watch, provide one or more databases (or --dir) on the command line or in the config file")
+			return
+		}
 
-		if err != nil || !path_exists {
-			log.Error("can't watch '%s', file not found", path)
+		if options.Dir != "" {
+			if info, err := os.Stat(options.Dir); err != nil || !info.IsDir() {
+				log.Error("can't watch '%s', directory not found", options.Dir)
+				return
+			}
+		}
+
+		if err := checkViews(options); err != nil {
+			log.Error("%s", err)
 			return
 		}
 
+		for _, database := range options.Databases {
+			path_exists, err := exists(database.Path)
+
+			if err != nil || !path_exists {
+				log.Error("can't watch '%s', file not found", database.Path)
+				return
+			}
+		}
+
+		if options.SSLClientCAFile != "" && !options.UseSSL {
+			log.Error("client certificates can only be required with --ssl")
+			return
+		}
+
+		if options.SigningKeyFile != "" {
+			if signing_key, err = loadSigningKey(options.SigningKeyFile); err != nil {
+				log.Error("unable to load signing key: %s", err)
+				return
+			}
+		}
+
 		addr := fmt.Sprintf("%s:%s", options.BindAddr, options.BindPort)
 
-		go listen(addr, path, options)
-		watch(path, options)
+		watchDatabases(addr, options)
 	} else if arguments["sync"].(bool) {
-		path, ok := arguments["<db.sql>"].(string)
+		if len(options.Databases) == 0 && options.Dir == "" {
+			options.Databases = []DatabaseConfig{{Path: "synced.sql"}}
+		}
 
-		if !ok {
-			path = "synced.sql"
+		if options.VerifyKeyFile != "" {
+			if verify_key, err = loadVerifyKey(options.VerifyKeyFile); err != nil {
+				log.Error("unable to load verify key: %s", err)
+				return
+			}
+		}
+
+		if options.DecryptKeyFile != "" {
+			if decrypt_key, err = loadDecryptKey(options.DecryptKeyFile); err != nil {
+				log.Error("unable to load decrypt key: %s", err)
+				return
+			}
+		}
+
+		synced_paths := make(map[string]bool)
+		for _, database := range options.Databases {
+			synced_path := filepath.Clean(database.Path)
+			if synced_paths[synced_path] {
+				log.Error("can't sync more than one database to '%s'", database.Path)
+				return
+			}
+			synced_paths[synced_path] = true
 		}
 
 		connect_addr := options.RemoteConn
 
-		sync(connect_addr, path, options)
+		if options.StatusAddr != "" {
+			go serveStatus(options.StatusAddr, options)
+		}
+
+		var wg sync.WaitGroup
+		for _, database := range options.Databases {
+			wg.Add(1)
+			go func(database DatabaseConfig) {
+				defer wg.Done()
+				syncDB(connect_addr, database, options, nil)
+			}(database)
+		}
+
+		if options.Dir != "" {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				syncDirectory(connect_addr, options.Dir, options)
+			}()
+		}
+		wg.Wait()
 	}
 }
 
@@ -164,12 +319,6 @@ func determineSqlitePath() string {
 	return ""
 }
 
-func sendMessage(message string) {
-	for e := channels.Front(); e != nil; e = e.Next() {
-		e.Value.(chan string) <- message
-	}
-}
-
 func exists(path string) (bool, error) {
 	_, err := os.Stat(path)
 	if err == nil {
@@ -181,196 +330,337 @@ func exists(path string) (bool, error) {
 	return false, err
 }
 
-func listen(addr string, path string, options WatchConfig) {
-	removeclients := make(chan *list.Element, 1)
-	listelement := make(chan *list.Element, 1)
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
 
-	go func() {
-		for {
-			select {
-			case c := <-clients:
-				listelement <- channels.PushBack(c)
-			case e := <-removeclients:
-				channels.Remove(e)
-			}
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// serveDump streams a dump of the DB straight through gzip to the client, so
+// memory use per client stays bounded no matter how large the DB is
+func serveDump(w http.ResponseWriter, r *http.Request, db *watchedDB, view replicaView, client *Identity) {
+	current, err := db.acquireView(view)
+	if err != nil {
+		log.Error("unable to build view of %s for %s: %s", db.name, r.RemoteAddr, err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if current == nil {
+		http.Error(w, "no snapshot available yet", 503)
+		return
+	}
+	defer current.release()
+
+	setVersionHeaders(w, current)
+
+	if notModified(r, current) {
+		w.WriteHeader(304)
+		return
+	}
+
+	source, err := openDatabase(current.path)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer source.Close()
+
+	w.Header().Set("Content-Type", "application/sql")
+	startSignedResponse(w)
+
+	sent := &countingWriter{w: w}
+
+	out, err := encodeResponse(w, r, client, sent)
+	if err != nil {
+		log.Error("unable to encrypt %s for %s: %s", db.name, r.RemoteAddr, err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	// the dump is signed as the syncer sees it, after decompression (and
+	// decryption)
+	digest := newPayloadDigest()
+
+	err = source.Dump(io.MultiWriter(out, digest))
+	if err == nil {
+		err = out.Close()
+	}
+
+	metricBytesServed.add(float64(sent.n), db.name, "latest")
+	metricBytesUncompressed.add(float64(digest.n), db.name, "latest")
+
+	if err != nil {
+		log.Error("unable to dump %s for %s: %s", db.name, r.RemoteAddr, err)
+
+		if sent.n == 0 {
+			w.Header().Del("Content-Encoding")
+			w.Header().Del("X-Watchdb-Encryption")
+			http.Error(w, err.Error(), 500)
+			return
 		}
-	}()
 
-	http.HandleFunc("/latest", func(w http.ResponseWriter, r *http.Request) {
-		if options.AuthKey != "" {
-			provided_key := r.Header.Get("Authorization")
-			if provided_key != options.AuthKey {
-				log.Warning("rejected connection from %s, incorrect auth key provided: '%s'", r.RemoteAddr, provided_key)
-				http.Error(w, "authorization required", 401)
+		// part of the dump is already on its way, so break the connection
+		// instead of letting the client mistake it for a complete one
+		panic(http.ErrAbortHandler)
+	}
+
+	finishSignedResponse(w, "latest", current, digest, client)
+}
+
+// serveWatch long polls for a single change, for syncers that don't support
+// event streams
+func serveWatch(w http.ResponseWriter, r *http.Request, db *watchedDB) {
+	log.Debug("remote syncer %s connected to %s", r.RemoteAddr, db.name)
+	defer log.Debug("remote syncer %s disconnected from %s", r.RemoteAddr, db.name)
+
+	notify := w.(http.CloseNotifier).CloseNotify()
+
+	message := db.subscribers.subscribe()
+	defer db.subscribers.unsubscribe(message)
+
+	// a syncer that's behind (e.g. missed a change while reconnecting)
+	// doesn't need to wait for the next one
+	if since := r.URL.Query().Get("since"); since != "" {
+		if current := db.acquireSnapshot(); current != nil {
+			behind := !notModified(r, current)
+			change := changeMessage(current)
+			current.release()
+
+			if behind {
+				io.WriteString(w, change)
 				return
 			}
 		}
+	}
 
-		log.Debug("sending DB to " + r.RemoteAddr)
+	select {
+	case <-notify:
+	case <-message:
+		if current := db.acquireSnapshot(); current != nil {
+			io.WriteString(w, changeMessage(current))
+			current.release()
+		}
+	case <-db.stopped:
+		http.Error(w, "database is no longer being watched", 404)
+	case <-shutting_down:
+		io.WriteString(w, "shutdown\n")
+	}
+}
 
-		out, err := exec.Command(sqlite_path, path, ".dump").Output()
-		if err != nil {
-			http.Error(w, err.Error(), 500)
+func serveDatabase(w http.ResponseWriter, r *http.Request, db *watchedDB, endpoint string, client *Identity, options WatchConfig) {
+	view := db.viewFor(client, options)
+
+	switch endpoint {
+	case "latest":
+		log.Debug("sending %s to %s", db.name, r.RemoteAddr)
+		serveDump(w, r, db, view, client)
+	case "pages":
+		servePages(w, r, db, view, client)
+	case "watch":
+		serveWatch(w, r, db)
+	case "events":
+		serveEvents(w, r, db)
+	case "changes":
+		// changes are sent as they are, so they'd get around encryption
+		if client != nil && client.Recipient != "" {
+			http.Error(w, "change feed isn't available to replicas that get encrypted payloads", 404)
 			return
 		}
+		serveChanges(w, r, db, view)
+	default:
+		http.NotFound(w, r)
+	}
+}
 
-		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") || len(out) < 1000 {
-			w.Write(out)
-		} else {
-			w.Header().Set("Content-Encoding", "gzip")
+type databaseInfo struct {
+	Name    string `json:"name"`
+	Version uint64 `json:"version"`
+	Hash    string `json:"hash"`
+}
 
-			var b bytes.Buffer
-			gz := gzip.NewWriter(&b)
-			if _, err := gz.Write(out); err != nil {
-				log.Error("unable to gzip sqlite output: ", err)
-				http.Error(w, err.Error(), 500)
-				return
-			}
-			if err := gz.Flush(); err != nil {
-				log.Error("unable to gzip sqlite output: ", err)
-				http.Error(w, err.Error(), 500)
-				return
+func listen(addr string, options WatchConfig) {
+	// each DB is served under /db/<name>/, where the name may itself contain
+	// slashes
+	http.HandleFunc("/db/", func(w http.ResponseWriter, r *http.Request) {
+		client, ok := authorized(w, r)
+		if !ok {
+			return
+		}
+
+		route := strings.TrimPrefix(r.URL.Path, "/db/")
+		i := strings.LastIndex(route, "/")
+		if i < 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		db := databases.get(route[:i])
+		if db == nil {
+			http.Error(w, fmt.Sprintf("unknown database '%s'", route[:i]), 404)
+			return
+		}
+
+		if !allowedDatabase(w, r, client, db, route[i+1:]) {
+			return
+		}
+
+		serveDatabase(w, r, db, route[i+1:], client, options)
+	})
+
+	http.HandleFunc("/dbs", func(w http.ResponseWriter, r *http.Request) {
+		client, ok := authorized(w, r)
+		if !ok {
+			return
+		}
+
+		list := []databaseInfo{}
+		for _, db := range databases.list() {
+			if client != nil && !client.allowed(db.name) {
+				continue
 			}
-			if err := gz.Close(); err != nil {
-				log.Error("unable to gzip sqlite output: ", err)
-				http.Error(w, err.Error(), 500)
-				return
+
+			info := databaseInfo{Name: db.name}
+			if current := db.acquireSnapshot(); current != nil {
+				info.Version = current.version
+				info.Hash = current.Hash()
+				current.release()
 			}
+			list = append(list, info)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	})
+
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		// Prometheus sends credentials as a bearer token
+		if key := r.Header.Get("Authorization"); strings.HasPrefix(key, "Bearer ") {
+			r.Header.Set("Authorization", strings.TrimPrefix(key, "Bearer "))
+		}
 
-			w.Write(b.Bytes())
+		if _, ok := authorized(w, r); !ok {
+			return
 		}
+
+		serveMetrics(w, r)
 	})
 
-	http.HandleFunc("/watch", func(w http.ResponseWriter, r *http.Request) {
-		if options.AuthKey != "" {
-			provided_key := r.Header.Get("Authorization")
-			if provided_key != options.AuthKey {
-				log.Warning("rejected connection from %s, incorrect auth key provided: '%s'", r.RemoteAddr, provided_key)
-				http.Error(w, "authorization required", 401)
+	// the unnamed routes serve the only DB, for syncers from before there
+	// could be more than one
+	for _, endpoint := range []string{"latest", "pages", "watch", "events", "changes"} {
+		endpoint := endpoint
+
+		http.HandleFunc("/"+endpoint, func(w http.ResponseWriter, r *http.Request) {
+			client, ok := authorized(w, r)
+			if !ok {
 				return
 			}
-		}
 
-		log.Debug("remote syncer " + r.RemoteAddr + " connected")
+			db := databases.only()
+			if db == nil {
+				http.Error(w, fmt.Sprintf("more than one database is being watched, use /db/<name>/%s", endpoint), 404)
+				return
+			}
+
+			if !allowedDatabase(w, r, client, db, endpoint) {
+				return
+			}
+
+			serveDatabase(w, r, db, endpoint, client, options)
+		})
+	}
+
+	if options.UseSSL {
+		tls_config, err := ssl.ServerConfig(options.SSLClientCAFile)
+		if err != nil {
+			log.Fatalf("unable to set up SSL: %s", err)
+		}
 
-		notify := w.(http.CloseNotifier).CloseNotify()
+		certs, err := newCertReloader(options.SSLCertFile, options.SSLKeyFile)
+		if err != nil {
+			log.Fatalf("unable to load certificate: %s", err)
+		}
+		tls_config.GetCertificate = certs.getCertificate
 
-		message := make(chan string, 1)
-		clients <- message
+		if err := certs.watch(databases.watcher); err != nil {
+			log.Warning("unable to watch certificate for changes, it won't be reloaded: %s", err)
+		}
 
-		element := <-listelement
+		if options.GeneratedCert {
+			go certs.renewGenerated(options)
+		}
 
-		select {
-		case <-notify:
-			log.Debug("remote syncer " + r.RemoteAddr + " disconnected")
-			removeclients <- element
-		case msg := <-message:
-			io.WriteString(w, msg)
-			log.Debug("remote syncer " + r.RemoteAddr + " disconnected")
-			removeclients <- element
+		if options.SSLClientCAFile != "" {
+			log.Notice("listening for SSL connections on %s, requiring client certificates", addr)
+		} else {
+			log.Notice("listening for SSL connections on " + addr)
 		}
-	})
 
-	if options.UseSSL {
-		log.Notice("listening for SSL connections on " + addr)
-		log.Fatal(http.ListenAndServeTLS(addr, options.SSLCertFile, options.SSLKeyFile, nil))
+		server := &http.Server{Addr: addr, TLSConfig: tls_config}
+		log.Fatal(server.ListenAndServeTLS("", ""))
 	} else {
 		log.Notice("listening on " + addr)
 		log.Fatal(http.ListenAndServe(addr, nil))
 	}
 }
 
-func getMD5(path string) string {
+func getMD5(path string) (string, error) {
 	h := md5.New()
 
 	file, err := os.Open(path)
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		io.WriteString(h, scanner.Text())
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
 	}
 
-	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
-	}
-
-	return string(h.Sum([]byte{}))
+	return string(h.Sum([]byte{})), nil
 }
 
-func watch(path string, options WatchConfig) {
-	watcher, err := fsnotify.NewWatcher()
+func watchDatabases(addr string, options WatchConfig) {
+	fw, err := newFileWatcher()
 	if err != nil {
 		log.Fatal(err)
 	}
+	databases.watcher = fw
 
-	db_md5 := getMD5(path)
-	done := make(chan bool)
-
-	needs_update := make(chan bool, 1)
-
-	go func() {
-		for {
-			<-needs_update
-
-			new_md5 := getMD5(path)
-			if db_md5 == new_md5 {
-				log.Debug("watched DB was modified, but checksum is the same, not notifying clients")
-			} else {
-				db_md5 = new_md5
-				if channels.Len() < 1 {
-					log.Info("watched DB was modified, but no clients to notify")
-				} else {
-					log.Info("watched DB was modified, notifying connected clients (%d)", channels.Len())
-					sendMessage("modified\n")
-				}
-			}
-
-			time.Sleep(time.Duration(options.SyncInterval) * time.Millisecond)
+	for _, database := range options.Databases {
+		name := database.Name
+		if name == "" {
+			name = defaultDatabaseName(database.Path)
 		}
-	}()
 
-	go func() {
-		for {
-			select {
-			case ev := <-watcher.Event:
-				if ev.IsDelete() {
-					log.Warning("watched DB was deleted, exiting")
-					done <- true
-				}
-
-				if ev.IsRename() {
-					log.Warning("watched DB was renamed, watching may no longer work")
-				}
+		db := newWatchedDB(name, database.Path)
+		db.filter = database.Filter
+		db.redaction = database.Redaction
 
-				if ev.IsModify() {
-					select {
-					case needs_update <- true:
-						// queued successfully
-					default:
-						// request is already in line, don't queue another one
-					}
-				}
-			case err := <-watcher.Error:
-				log.Error("error watching file: %s", err)
-				done <- true
-			}
+		if err := databases.add(db, options); err != nil {
+			log.Fatalf("unable to watch %s: %s", database.Path, err)
 		}
-	}()
-
-	log.Notice("watching %s", path)
+	}
 
-	err = watcher.Watch(path)
-	if err != nil {
-		log.Fatal(err)
+	if options.Dir != "" {
+		log.Notice("watching %s for databases", options.Dir)
+		newDiscovery(options.Dir, options).scan(options.Dir)
 	}
 
-	<-done
+	replicaKeyring.load(options)
+
+	handleShutdown()
+	handleReload(options)
 
-	watcher.Close()
+	go listen(addr, options)
+	fw.run()
+
+	fw.watcher.Close()
 }
 
 func copyFileContents(src, dst string) (err error) {
@@ -396,117 +686,399 @@ func copyFileContents(src, dst string) (err error) {
 	return
 }
 
-func sync(addr string, path string, options WatchConfig) {
-	var poll_url string
-	var download_url string
+func queueDownload(download chan bool) {
+	select {
+	case download <- true:
+		// add a download to the queue
+	default:
+		// already a download in queue, don't add another one
+	}
+}
 
-	if options.UseSSL {
-		poll_url = fmt.Sprintf("https://%s/watch", addr)
-		download_url = fmt.Sprintf("https://%s/latest", addr)
-	} else {
-		poll_url = fmt.Sprintf("http://%s/watch", addr)
-		download_url = fmt.Sprintf("http://%s/latest", addr)
+func replicaVersionPath(path string) string {
+	return fmt.Sprintf("%s.version", path)
+}
+
+// readReplicaVersion returns the upstream version the local DB was last
+// synced to, or 0 if unknown
+func readReplicaVersion(path string) (uint64, string) {
+	if dbexists, _ := exists(path); !dbexists {
+		return 0, ""
 	}
 
-	done := make(chan bool)
-	download := make(chan bool, 1)
+	data, err := ioutil.ReadFile(replicaVersionPath(path))
+	if err != nil {
+		return 0, ""
+	}
+
+	return parseVersion(string(data))
+}
+
+// readReplicaRedaction returns the redaction profile upstream built the
+// local DB with, or "" if it wasn't redacted
+func readReplicaRedaction(path string) string {
+	data, err := ioutil.ReadFile(replicaVersionPath(path))
+	if err != nil {
+		return ""
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return ""
+	}
+
+	return strings.Join(fields[2:], " ")
+}
+
+// writeReplicaVersion records the upstream version the local DB was synced
+// to, along with the redaction profile it was built with
+func writeReplicaVersion(path string, version uint64, hash string, redaction string) {
+	if previous := readReplicaRedaction(path); previous != redaction {
+		if redaction == "" {
+			log.Notice("%s is no longer redacted upstream", path)
+		} else {
+			log.Notice("%s is redacted upstream with profile %s", path, redaction)
+		}
+	}
+
+	// the fields are separated by spaces, so a missing hash still needs one
+	if hash == "" {
+		hash = noHash
+	}
+
+	record := fmt.Sprintf("%d %s", version, hash)
+	if redaction != "" {
+		record += " " + redaction
+	}
+
+	err := ioutil.WriteFile(replicaVersionPath(path), []byte(record+"\n"), 0600)
+	if err != nil {
+		log.Warning("unable to record synced DB version: %s", err)
+	}
+}
+
+// importPath is where a new copy of the DB is built before it's swapped in,
+// beside the DB itself so the final rename stays on one filesystem
+func importPath(path string) string {
+	return filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.watchdb-import", filepath.Base(path)))
+}
+
+// replaceReplica verifies the freshly built DB at import_path and atomically
+// renames it over the replica, so readers only ever see a complete copy
+func replaceReplica(import_path string, path string) error {
+	db, err := openDatabase(import_path)
+	if err != nil {
+		return syncFailure("import", "imported DB failed verification, keeping the current one: %s", err)
+	}
+
+	err = db.IntegrityCheck()
+	db.Close()
+	if err != nil {
+		return syncFailure("import", "imported DB failed verification, keeping the current one: %s", err)
+	}
+
+	err = os.Chmod(import_path, 0400)
+	if err != nil {
+		return syncFailure("import", "unable to change permissions on DB following import, err: %s", err)
+	}
+
+	err = os.Rename(import_path, path)
+	if err != nil {
+		return syncFailure("import", "unable to move imported DB into place: %s", err)
+	}
+
+	return nil
+}
 
+// syncDump replaces the local DB with a full SQL dump from upstream
+func syncDump(client *http.Client, download_url string, path string, options WatchConfig) error {
 	sql_backup_path := fmt.Sprintf("%s.new.sql", path)
-	backup_path := fmt.Sprintf("%s.old", path)
+
+	req, err := http.NewRequest("GET", download_url, nil)
+	if err != nil {
+		return err
+	}
+	if options.AuthKey != "" {
+		req.Header.Add("Authorization", options.AuthKey)
+	}
+	if version, hash := readReplicaVersion(path); version > 0 {
+		req.Header.Add("If-None-Match", fmt.Sprintf(`"%d-%s"`, version, hash))
+	}
+
+	start := time.Now()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 304 {
+		log.Debug("local DB already at upstream version %s", resp.Header.Get("X-Watchdb-Version"))
+		return nil
+	}
+
+	if resp.StatusCode != 200 {
+		return syncFailure("upstream", "upstream returned %s", resp.Status)
+	}
+
+	version, hash := parseVersion(resp.Header.Get("X-Watchdb-Version") + " " + resp.Header.Get("X-Watchdb-Hash"))
+
+	_ = os.Remove(sql_backup_path)
+	out, err := os.Create(sql_backup_path)
+	if err != nil {
+		return fmt.Errorf("unable to write latest DB to file: %s", err)
+	}
+	defer os.Remove(sql_backup_path)
+
+	body, err := decodeResponse(resp)
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	digest := newPayloadDigest()
+	_, err = io.Copy(io.MultiWriter(out, digest), body)
+	out.Close()
+	if err != nil {
+		return wrapFailure(err, "network", "unable to download latest DB: %s", err)
+	}
+
+	if err := verifyPayload(resp, "latest", digest, options); err != nil {
+		return err
+	}
+	metricDownloadDuration.since(start, path, "dump")
+	metricBytesReceived.add(float64(digest.n), path, "dump")
+
+	import_start := time.Now()
+
+	in, err := os.Open(sql_backup_path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	import_path := importPath(path)
+	_ = os.Remove(import_path)
+	defer os.Remove(import_path)
+
+	db, err := openDatabase(import_path)
+	if err != nil {
+		return err
+	}
+
+	err = db.Restore(in)
+	db.Close()
+	if err != nil {
+		return syncFailure("import", "unable to import newly downloaded DB from upstream: %s", err)
+	}
+
+	if err := backupReplica(path, options); err != nil {
+		return err
+	}
+
+	if err := replaceReplica(import_path, path); err != nil {
+		return err
+	}
+	metricImportDuration.since(import_start, path, "dump")
+
+	writeReplicaVersion(path, version, hash, resp.Header.Get("X-Watchdb-Redaction"))
+	archiveReplica(path, version, hash, resp.Header.Get("X-Watchdb-Redaction"), options)
+
+	log.Info("updated %s with latest (version %d)", path, version)
+
+	return nil
+}
+
+// pollOnce long polls upstream for a single change, for watchers without
+// event stream support
+func pollOnce(client *http.Client, poll_url string, options WatchConfig, status *replicaStatus, known_version *uint64, download chan bool) error {
+	watch_url := poll_url
+	if *known_version > 0 {
+		watch_url = fmt.Sprintf("%s?since=%d", poll_url, *known_version)
+	}
+
+	req, err := http.NewRequest("GET", watch_url, nil)
+	if err != nil {
+		return err
+	}
+	if options.AuthKey != "" {
+		req.Header.Add("Authorization", options.AuthKey)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("unable to parse upstream body: %s", err)
+	}
+
+	if resp.StatusCode == 401 {
+		return errUnauthorized
+	}
+
+	fields := strings.Fields(string(body))
+	if len(fields) > 0 && fields[0] == "shutdown" {
+		return errUpstreamShutdown
+	}
+
+	if len(fields) == 0 || fields[0] != "modified" {
+		return fmt.Errorf("unknown body received from upstream: %s", body)
+	}
+
+	if len(fields) > 1 {
+		log.Debug("upstream DB changed, now at version %s", fields[1])
+
+		if version, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			*known_version = version
+			status.announced(version)
+		}
+	}
+
+	queueDownload(download)
+
+	return nil
+}
+
+// databaseURL is where a DB is served upstream, by name or (for syncing the
+// only DB of a watcher) at the root
+func databaseURL(addr string, name string, options WatchConfig) string {
+	base_url := fmt.Sprintf("http://%s", addr)
+	if options.UseSSL {
+		base_url = fmt.Sprintf("https://%s", addr)
+	}
+
+	if name == "" {
+		return base_url
+	}
+
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+
+	return fmt.Sprintf("%s/db/%s", base_url, strings.Join(parts, "/"))
+}
+
+func syncClient(options WatchConfig) *http.Client {
+	tls_config, err := ssl.ClientConfig(ssl.ClientOptions{
+		CAFile:     options.SSLCAFile,
+		Pin:        options.SSLPin,
+		SkipVerify: options.SkipSSLVerify,
+		CertFile:   options.SSLClientCertFile,
+		KeyFile:    options.SSLClientKeyFile,
+	})
+	if err != nil {
+		log.Fatalf("unable to set up SSL: %s", err)
+	}
 
 	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: options.SkipSSLVerify},
+		TLSClientConfig: tls_config,
 	}
-	client := &http.Client{Transport: tr}
 
-	go func() {
-		for {
-			<-download
+	return &http.Client{Transport: tr}
+}
 
-			req, err := http.NewRequest("GET", download_url, nil)
-			if options.AuthKey != "" {
-				req.Header.Add("Authorization", options.AuthKey)
-			}
+// syncDB keeps the local copy of one upstream DB in sync, until stop is
+// closed or upstream rejects us
+func syncDB(addr string, database DatabaseConfig, options WatchConfig, stop chan bool) {
+	path := database.Path
+	base_url := databaseURL(addr, database.Name, options)
 
-			resp, err := client.Do(req)
+	poll_url := base_url + "/watch"
+	events_url := base_url + "/events"
+	download_url := base_url + "/latest"
+	pages_url := base_url + "/pages"
 
-			if err != nil {
-				log.Warning("unable to download latest DB from upstream, retrying in 5s: %s", err)
+	done := make(chan bool)
+	download := make(chan bool, 1)
 
-				go func() {
-					time.Sleep(time.Duration(5) * time.Second)
-					select {
-					case download <- true:
-						// add a download to the queue
-					default:
-						// already a download in queue, don't add another one
-					}
-				}()
+	client := syncClient(options)
+	status := replicas.add(database.Name, path)
 
-				continue
-			}
+	go func() {
+		seeded := database.Seed == ""
 
-			_ = os.Remove(sql_backup_path)
-			out, err := os.Create(sql_backup_path)
-			if err != nil {
-				log.Error("unable to write latest DB to file: %s", err)
-				continue
+		for {
+			select {
+			case <-download:
+			case <-stop:
+				return
 			}
 
-			defer out.Close()
-			io.Copy(out, resp.Body)
+			// the seed is checked against upstream, so it waits for the first
+			// sync rather than being installed right away
+			if !seeded {
+				err := seedReplica(client, pages_url, database, options)
+
+				if err == errSeedUnchecked {
+					go func() {
+						time.Sleep(time.Duration(5) * time.Second)
+						queueDownload(download)
+					}()
 
-			if dbexists, _ := exists(path); dbexists {
-				err = copyFileContents(path, backup_path)
-				if err != nil {
-					log.Error("unable to back up current sqlite database: %s", err)
 					continue
 				}
 
-				err = os.Chmod(path, 0600)
+				seeded = true
 				if err != nil {
-					log.Error("unable to change permissions on existing DB prior to import, err: %s", err)
-					continue
+					log.Error("not seeding %s from %s, syncing all of it from upstream instead: %s", path, database.Seed, err)
 				}
 			}
 
-			drop_sql_command := "PRAGMA writable_schema = 1; delete from sqlite_master where type in ('table', 'index', 'trigger'); PRAGMA writable_schema = 0; VACUUM; PRAGMA INTEGRITY_CHECK;"
-			drop_sqlite_out, err := exec.Command(sqlite_path, path, drop_sql_command).CombinedOutput()
-			if err != nil {
-				log.Error("unable to drop existing DB prior to import, output: %s", string(drop_sqlite_out))
-				continue
+			err := syncPages(client, pages_url, path, options)
+			if err == errPagesUnsupported {
+				log.Debug("upstream doesn't support page-level sync, downloading full dump")
+				err = syncDump(client, download_url, path, options)
 			}
 
-			sql_command := fmt.Sprintf(".read %s", sql_backup_path)
-			sqlite_out, err := exec.Command(sqlite_path, path, sql_command).CombinedOutput()
-			if err != nil {
-				log.Error("unable to import newly downloaded DB from upstream, output: %s", string(sqlite_out))
+			if err == errSnapshotChanged {
+				log.Debug("upstream DB changed during sync, retrying")
+				queueDownload(download)
 				continue
 			}
 
-			err = os.Chmod(path, 0400)
 			if err != nil {
-				log.Error("unable to change permissions on DB following import, err: %s", err)
+				status.failed(err)
+				log.Warning("unable to sync %s from upstream, retrying in 5s: %s", path, err)
+
+				go func() {
+					time.Sleep(time.Duration(5) * time.Second)
+					queueDownload(download)
+				}()
+
 				continue
 			}
 
-			log.Info("updated DB on disk with latest")
-
-			_ = os.Remove(sql_backup_path)
+			status.synced()
 		}
 	}()
 
 	go func() {
 		initial_sync_done := false
+		bootstrapped := false
+		use_events := true
+		var known_version uint64
 
 		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
 			not_successful := false
 
 			go func() {
 				time.Sleep(time.Duration(400) * time.Millisecond)
 
 				if !not_successful {
-					log.Notice("connected to upstream")
+					log.Notice("connected to upstream for %s", path)
+					status.setConnected(true)
 
 					if !initial_sync_done {
 						initial_sync_done = true
@@ -515,93 +1087,110 @@ func sync(addr string, path string, options WatchConfig) {
 							orig_backup_path := fmt.Sprintf("%s.orig", path)
 							err := copyFileContents(path, orig_backup_path)
 							if err != nil {
-								log.Fatal("unable to back up current sqlite database: %s", err)
+								log.Fatalf("unable to back up current sqlite database: %s", err)
 							}
 
 							log.Notice("syncing upstream DB to %s", path)
 							log.Info("if that's not what you meant to do, we've saved a backup at %s", orig_backup_path)
 						}
 
-						log.Notice("running initial sync")
+						log.Notice("running initial sync of %s", path)
 						download <- true
 					}
 				}
 			}()
 
-			req, err := http.NewRequest("GET", poll_url, nil)
-			if options.AuthKey != "" {
-				req.Header.Add("Authorization", options.AuthKey)
+			// a change we've already been told about is being (or has been)
+			// downloaded, so only ask about anything newer than that
+			if version, _ := readReplicaVersion(path); version > known_version {
+				known_version = version
 			}
 
-			resp, err := client.Do(req)
-
-			if err != nil {
-				not_successful = true
-
-				if strings.Contains(err.Error(), "malformed HTTP response") {
-					log.Error("it looks like the upstream server is using SSL, did you forget to specify --ssl?")
+			var err error
+			if use_events {
+				err = followEvents(client, events_url, options, status, &known_version, download)
 
-					os.Exit(1)
-				}
-
-				if strings.Contains(err.Error(), "certificate signed by unknown authority") {
-					log.Error("encountered a certificate error when trying to verify SSL, you may want to use --ssl-skip-verify if this is a self-signed certificate")
-
-					os.Exit(1)
+				if err == errEventsUnsupported && database.Name != "" {
+					// every watcher serving named DBs has event streams, so
+					// it's the DB that's missing
+					not_successful = true
+					status.setConnected(false)
+					log.Warning("upstream isn't serving a database named '%s', retrying in 5s", database.Name)
+					time.Sleep(time.Duration(5) * time.Second)
+					continue
 				}
 
-				if strings.Contains(err.Error(), "oversized record received") && options.UseSSL {
-					log.Error("it looks like you're trying to connect through SSL, but the server isn't set up to use SSL, try removing --ssl or properly setting it up on the server")
-
-					os.Exit(1)
+				if err == errEventsUnsupported {
+					log.Debug("upstream doesn't support event streams, falling back to long polling")
+					use_events = false
+					not_successful = true
+					continue
 				}
+			} else {
+				err = pollOnce(client, poll_url, options, status, &known_version, download)
+			}
 
-				log.Warning("unable to watch for upstream updates: %s", err)
-
-				time.Sleep(time.Duration(5) * time.Second)
+			if err == nil {
 				continue
 			}
 
-			defer resp.Body.Close()
+			not_successful = true
+			status.setConnected(false)
 
-			body, err := ioutil.ReadAll(resp.Body)
+			if err == errUnauthorized {
+				status.failed(err)
 
-			if err != nil {
-				log.Warning("unable to parse upstream body: %s", err)
-				not_successful = true
-				time.Sleep(time.Duration(5) * time.Second)
-				continue
-			}
-
-			if resp.StatusCode == 401 {
 				if options.AuthKey == "" {
 					log.Error("upstream requires an authentication key to connect, provide via --auth-key")
 				} else {
-					log.Error("authentication key '%s' rejected by server, make sure it was entered correctly", options.AuthKey)
+					log.Error("authentication key rejected by server, make sure it was entered correctly")
 				}
 
 				done <- true
-				not_successful = true
-
 				return
 			}
 
-			if strings.TrimSpace(string(body)) == "modified" {
-				select {
-				case download <- true:
-					// add a download to the queue
-				default:
-					// already a download in queue, don't add another one
-				}
+			if strings.Contains(err.Error(), "malformed HTTP response") {
+				log.Error("it looks like the upstream server is using SSL, did you forget to specify --ssl?")
+
+				os.Exit(1)
+			}
+
+			if strings.Contains(err.Error(), "certificate signed by unknown authority") {
+				log.Error("encountered a certificate error when trying to verify SSL, trust the watcher with --ssl-ca or --ssl-pin (see the pin in its log), or use --ssl-skip-verify if this is a self-signed certificate")
 
+				os.Exit(1)
+			}
+
+			if strings.Contains(err.Error(), "oversized record received") && options.UseSSL {
+				log.Error("it looks like you're trying to connect through SSL, but the server isn't set up to use SSL, try removing --ssl or properly setting it up on the server")
+
+				os.Exit(1)
+			}
+
+			if err == errUpstreamShutdown {
+				log.Notice("upstream is shutting down, reconnecting in 5s")
 			} else {
-				log.Warning("unknown body received from upstream: %s", body)
-				not_successful = true
-				time.Sleep(time.Duration(5) * time.Second)
-				continue
+				log.Warning("unable to watch for upstream updates to %s: %s", path, err)
 			}
+
+			// until upstream is back, the newest version it archived is the
+			// next best thing
+			if options.BootstrapFrom != "" && !bootstrapped {
+				bootstrapped = true
+
+				if err := bootstrapReplica(database, options); err != nil {
+					log.Warning("unable to bootstrap %s from %s: %s", path, options.BootstrapFrom, err)
+				}
+			}
+
+			time.Sleep(time.Duration(5) * time.Second)
 		}
 	}()
 
-	<-done
+	select {
+	case <-done:
+	case <-stop:
+		replicas.remove(path)
+	}
 }
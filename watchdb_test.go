@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReplaceReplica(t *testing.T) {
+	path, reader := createTestDB(t, "CREATE TABLE t(x); INSERT INTO t VALUES('old');")
+
+	build := func(script string) string {
+		import_path := importPath(path)
+
+		db, err := openDatabase(import_path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		if err := db.Exec(script); err != nil {
+			t.Fatal(err)
+		}
+
+		return import_path
+	}
+
+	import_path := build("CREATE TABLE t(x); INSERT INTO t VALUES('new');")
+	if err := replaceReplica(import_path, path); err != nil {
+		t.Fatal(err)
+	}
+
+	// a reader that had the DB open keeps its complete copy, and new readers
+	// get the other complete copy
+	if values := queryValues(t, reader, "SELECT x FROM t"); strings.Join(values, ",") != "old" {
+		t.Errorf("open reader saw %v", values)
+	}
+
+	replica, err := openDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.Close()
+
+	if values := queryValues(t, replica, "SELECT x FROM t"); strings.Join(values, ",") != "new" {
+		t.Errorf("replaced replica has %v", values)
+	}
+
+	if import_exists, _ := exists(import_path); import_exists {
+		t.Error("import was left behind")
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0400 {
+		t.Errorf("replaced replica isn't read-only (%v)", err)
+	}
+
+	// an import that doesn't check out is never swapped in
+	if err := ioutil.WriteFile(import_path, append(append([]byte{}, sqliteHeader...), make([]byte, 4096)...), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	err = replaceReplica(import_path, path)
+	if err == nil || failureReason(err) != "import" {
+		t.Fatalf("expected an import failure, got %v", err)
+	}
+
+	if values := queryValues(t, replica, "SELECT x FROM t"); strings.Join(values, ",") != "new" {
+		t.Errorf("replica has %v after a failed import", values)
+	}
+}
+
+func TestReplicaVersionNeedsReplica(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "replica.db")
+
+	// a version left behind by a replica that's since been deleted doesn't
+	// say anything about a new one
+	if err := ioutil.WriteFile(replicaVersionPath(path), []byte("7 abc123\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if version, hash := readReplicaVersion(path); version != 0 || hash != "" {
+		t.Errorf("missing replica is at version %d (%s)", version, hash)
+	}
+}
+
+func newDumpServer(t *testing.T, db *watchedDB) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveDump(w, r, db, replicaView{}, nil)
+	}))
+	t.Cleanup(server.Close)
+
+	return server.URL + "/latest"
+}
+
+func TestSyncDump(t *testing.T) {
+	db, source := watchTestDB(t, auditedSchema)
+	if _, err := db.refreshSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	download_url := newDumpServer(t, db)
+
+	// the replica is replaced even while something has it open
+	path, replica := createTestDB(t, "CREATE TABLE users(id, email); INSERT INTO users VALUES(1, 'stale@example.com');")
+
+	if err := syncDump(http.DefaultClient, download_url, path, WatchConfig{NoBackup: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if values := queryValues(t, replica, "SELECT email FROM users"); strings.Join(values, ",") != "stale@example.com" {
+		t.Errorf("open reader saw %v", values)
+	}
+
+	synced, err := openDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer synced.Close()
+
+	query := "SELECT email FROM users ORDER BY id"
+	if values, expected := queryValues(t, synced, query), queryValues(t, source, query); strings.Join(values, ",") != strings.Join(expected, ",") {
+		t.Errorf("synced replica has %v, expected %v", values, expected)
+	}
+
+	// the dump's triggers come along too
+	if triggers := queryValues(t, synced, "SELECT name FROM sqlite_master WHERE type = 'trigger'"); len(triggers) != 2 {
+		t.Errorf("synced replica has triggers %v", triggers)
+	}
+
+	for _, leftover := range []string{importPath(path), path + ".new.sql"} {
+		if leftover_exists, _ := exists(leftover); leftover_exists {
+			t.Errorf("%s was left behind", leftover)
+		}
+	}
+}